@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eggsampler/acme"
@@ -25,25 +30,207 @@ type Account struct {
 
 	AccountName string
 	MailList    []string
+	Status      string
+
+	// name of the CA profile the account is registered at, empty for the default
+	CaName string
+
+	// owner of the account
+	Tenant string
 
 	acmeAccount *acme.Account
 }
 
 type Domain struct {
+	Tenant        string
 	Domain        string
+	AltNames      []string
 	AccountMail   string
 	ChallengeType string
 	Status        string
 
-	CreateTime string
-	IssueTime  string
+	// dns provider of the tenant publishing the records of dns challenges
+	DnsProvider string
+
+	// ordered accounts of the domain, possibly at different CAs.
+	// AccountMail is the one in use and falls back to the next after failures.
+	AccountList []string
+
+	CreateTime    string
+	ChallengeTime string
+	IssueTime     string
+	ExpireTime    string
+	// next lookup of dns-01 records not yet propagated, apart from retries of failures
+	PropagationCheckTime string
+
+	// failed attempts since the last success
+	Attempts        int
+	LastError       string
+	LastProblem     *acme.Problem
+	NextAttemptTime string
+
+	// PEM CSR submitted by the requester, finalizes orders instead of a generated key
+	CsrPem string
+
+	// extensions and subject fields of generated csr
+	CsrOptions CsrOptions
+
+	// key policy: reuse the key of the current certificate on renewal,
+	// and rotate it after KeyRotationDays if greater than 0
+	ReuseKey        bool
+	KeyRotationDays int
+	KeyCreateTime   string
+
+	// refresh time of the ocsp response of the current certificate
+	OcspRefreshTime string
+	// the current certificate is revoked, its key is never reused
+	Revoked bool
+
+	// the order is persisted before further steps in order to resume it after restart
+	OrderUrl string
+	// the key of the order is kept in the order key table, it never leaves with the domain record
+	OrderPrivateKeyString string `json:"-"`
 
 	ChallengeData string
 	OrderData     string
 }
 
+// Names returns all names of the certificate, the main domain first
+func (this *Domain) Names() []string {
+	return append([]string{this.Domain}, this.AltNames...)
+}
+
+// challenges returns the challenges of all authorizations of the order.
+// Domains saved before multiple names were supported hold a single challenge.
+func (this *Domain) challenges() ([]Challenge, error) {
+	var chals []Challenge
+	data := strings.TrimSpace(this.ChallengeData)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(data, "{") {
+		chal := Challenge{}
+		err := json.Unmarshal([]byte(data), &chal)
+		if err != nil {
+			return nil, err
+		}
+		return append(chals, chal), nil
+	}
+	err := json.Unmarshal([]byte(data), &chals)
+	if err != nil {
+		return nil, err
+	}
+	return chals, nil
+}
+
+var (
+	OrderPending    = "pending"
+	OrderReady      = "ready"
+	OrderProcessing = "processing"
+	OrderValid      = "valid"
+	OrderInvalid    = "invalid"
+)
+
+var (
+	AuthorizationPending     = "pending"
+	AuthorizationValid       = "valid"
+	AuthorizationInvalid     = "invalid"
+	AuthorizationDeactivated = "deactivated"
+	AuthorizationExpired     = "expired"
+	AuthorizationRevoked     = "revoked"
+)
+
+// Authorization is the cached authorization state of an identifier for an account
+type Authorization struct {
+	Tenant      string
+	AccountMail string
+	Identifier  string
+	Url         string
+	Status      string
+	Expires     string
+	UpdateTime  string
+}
+
+func authorizationRecords(tenant string, mail string, auths []acme.Authorization) []*Authorization {
+	nowTime := time.Now().Format(time.RFC3339Nano)
+	result := make([]*Authorization, len(auths))
+	for i, v := range auths {
+		identifier := v.Identifier.Value
+		if v.Wildcard {
+			identifier = "*." + identifier
+		}
+		result[i] = &Authorization{
+			Tenant:      tenant,
+			AccountMail: mail,
+			Identifier:  identifier,
+			Url:         v.URL,
+			Status:      v.Status,
+			Expires:     v.Expires.Format(time.RFC3339Nano),
+			UpdateTime:  nowTime,
+		}
+	}
+	return result
+}
+
+var (
+	ChallengePending    = "pending"
+	ChallengeProcessing = "processing"
+	ChallengeValid      = "valid"
+	ChallengeInvalid    = "invalid"
+)
+
+// ProblemError carries the problem document of a failed authorization, challenge or order
+type ProblemError struct {
+	Message string
+	Problem acme.Problem
+
+	// identifier of the failed validation if any
+	Identifier string
+	// Retry-After of a rate limited response if any
+	RetryAfter time.Time
+}
+
+func (this *ProblemError) Error() string {
+	if len(this.Problem.Type) == 0 && len(this.Problem.Detail) == 0 {
+		return this.Message
+	}
+	return this.Message + ": " + this.Problem.Type + " " + this.Problem.Detail
+}
+
+// problemOf returns the problem document of the error if there is one
+func problemOf(err error) *acme.Problem {
+	switch v := err.(type) {
+	case *ProblemError:
+		return &v.Problem
+	case acme.Problem:
+		return &v
+	default:
+		return nil
+	}
+}
+
+var (
+	IdentifierDns = "dns"
+	IdentifierIp  = "ip"
+)
+
+// challenge types of domains and their acme challenge types
+var acmeChallengeTypes = map[string]string{
+	"dns":      acme.ChallengeTypeDNS01,
+	"http":     acme.ChallengeTypeHTTP01,
+	"tls-alpn": acme.ChallengeTypeTLSALPN01,
+}
+
+func identifierType(name string) string {
+	if net.ParseIP(name) != nil {
+		return IdentifierIp
+	}
+	return IdentifierDns
+}
+
 type AcmeClient struct {
-	client acme.Client
+	client       acme.Client
+	directoryUrl string
 }
 
 // copy from acme client
@@ -61,6 +248,9 @@ type Challenge struct {
 
 	// Authorization url provided by the rel="up" Link http header
 	AuthorizationURL string `json:"authorizationURL"`
+
+	// identifier value of the authorization
+	Identifier string `json:"identifier"`
 }
 
 func challengeConvertLocal(chal acme.Challenge) Challenge {
@@ -76,7 +266,7 @@ func challengeConvertLocal(chal acme.Challenge) Challenge {
 	}
 }
 
-func challengeConvertOrigin(chal acme.Challenge) acme.Challenge {
+func challengeConvertOrigin(chal Challenge) acme.Challenge {
 	return acme.Challenge{
 		Type:             chal.Type,
 		URL:              chal.URL,
@@ -89,29 +279,111 @@ func challengeConvertOrigin(chal acme.Challenge) acme.Challenge {
 	}
 }
 
-func newAcmeClient(production bool) *AcmeClient {
-	var url string
-	if production {
-		url = acme.LetsEncryptProduction
-	} else {
-		url = acme.LetsEncryptStaging
+// timeout of a single http request to the CA
+var acmeHttpTimeout = 60 * time.Second
+
+// newAcmeClient creates the client of the CA, its requests are interrupted when ctx is done
+func newAcmeClient(ctx context.Context, url string) *AcmeClient {
+	httpClient := &http.Client{
+		Timeout:   acmeHttpTimeout,
+		Transport: &contextTransport{base: http.DefaultTransport, ctx: ctx},
 	}
-	client, err := acme.NewClient(url)
+	client, err := acme.NewClient(url, acme.WithHTTPClient(httpClient))
 	if err != nil {
 		log.Fatalf("Error connecting to acme directory: %v", err)
 	}
 	client.PollTimeout = 5 * time.Second
 	return &AcmeClient{
-		client: client,
+		client:       client,
+		directoryUrl: url,
+	}
+}
+
+// rateLimited runs a call which may be rate limited by the CA.
+// The call gets a client of its own, so that the Retry-After header seen by its transport
+// belongs to this call and not to a concurrent one.
+// A rateLimited problem is returned as ProblemError with the Retry-After of the response.
+func (this *AcmeClient) rateLimited(ctx context.Context, message string, call func(client acme.Client) error) error {
+	transport := &retryAfterTransport{base: &contextTransport{base: http.DefaultTransport, ctx: ctx}}
+	client, err := acme.NewClient(this.directoryUrl, acme.WithHTTPClient(&http.Client{
+		Timeout:   acmeHttpTimeout,
+		Transport: transport,
+	}))
+	if err != nil {
+		return err
+	}
+	client.PollTimeout = this.client.PollTimeout
+
+	err = call(client)
+	problem, ok := err.(acme.Problem)
+	if !ok || problem.Type != rateLimitedProblemType {
+		return err
 	}
+	return &ProblemError{
+		Message:    message,
+		Problem:    problem,
+		RetryAfter: transport.take(),
+	}
+}
+
+// contextTransport interrupts requests when ctx is done,
+// since the acme client creates its requests without context
+type contextTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
 }
 
-func (this *AcmeClient) LoadAccount(acc *Account) (*Account, error) {
-	privData, err := base64.StdEncoding.DecodeString(acc.PrivateKeyString)
+func (this *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := this.ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the request keeps its own context, which carries the timeout of the http client
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-this.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	release := func() {
+		close(stop)
+		cancel()
+	}
+
+	resp, err := this.base.RoundTrip(req.WithContext(ctx))
 	if err != nil {
+		release()
+		return nil, err
+	}
+	// the body is read after RoundTrip returns
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody releases the request context when the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (this *releaseBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.once.Do(this.release)
+	return err
+}
+
+func (this *Account) privateKey() (crypto.Signer, error) {
+	return decodePrivateKey(this.PrivateKeyString)
+}
+
+func (this *AcmeClient) LoadAccount(ctx context.Context, acc *Account) (*Account, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	privKey, err := x509.ParseECPrivateKey(privData)
+	privKey, err := acc.privateKey()
 	if err != nil {
 		return nil, err
 	}
@@ -131,11 +403,40 @@ func (this *AcmeClient) LoadAccount(acc *Account) (*Account, error) {
 
 	acc.acmeAccount = &newAcmeAccount
 	acc.AccountUrl = newAcmeAccount.URL
+	acc.Status = newAcmeAccount.Status
+
+	return acc, nil
+}
 
+// UpdateContacts replaces the contact mails of the account at the CA
+func (this *AcmeClient) UpdateContacts(ctx context.Context, acc *Account, mailList []string) (*Account, error) {
+	updated := *acc
+	updated.MailList = mailList
+	return this.LoadAccount(ctx, &updated)
+}
+
+// DeactivateAccount deactivates the account at the CA. This can not be undone.
+func (this *AcmeClient) DeactivateAccount(ctx context.Context, acc *Account) (*Account, error) {
+	acc, err := this.LoadAccount(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deactivated, err := this.client.DeactivateAccount(*acc.acmeAccount)
+	if err != nil {
+		return nil, err
+	}
+	acc.acmeAccount = &deactivated
+	acc.Status = deactivated.Status
 	return acc, nil
 }
 
-func (this *AcmeClient) Register(mailList []string) (*Account, error) {
+func (this *AcmeClient) Register(ctx context.Context, mailList []string) (*Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, err
@@ -159,136 +460,257 @@ func (this *AcmeClient) Register(mailList []string) (*Account, error) {
 	account.PrivateKeyString = base64.StdEncoding.EncodeToString(privKeyData)
 	account.AccountUrl = acc.URL
 	account.MailList = mailList
+	account.Status = acc.Status
+
+	return account, nil
+}
+
+// ImportAccount looks up the existing account of the key at the CA and keeps the key
+func (this *AcmeClient) ImportAccount(ctx context.Context, privKey crypto.Signer, mailList []string) (*Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	acc, err := this.client.NewAccount(privKey, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyString, err := encodePrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// prefer contacts known by the CA
+	var contactMails []string
+	for _, v := range acc.Contact {
+		if strings.HasPrefix(v, "mailto:") {
+			contactMails = append(contactMails, strings.TrimPrefix(v, "mailto:"))
+		}
+	}
+	if len(contactMails) == 0 {
+		contactMails = mailList
+	}
+
+	account := new(Account)
+	account.PrivateKeyString = privKeyString
+	account.AccountUrl = acc.URL
+	account.MailList = contactMails
+	account.Status = acc.Status
 
 	return account, nil
 }
 
-func (this *AcmeClient) AcquireChallenging(acc *Account, domain *Domain) (orderData, chaldata []byte, token string, err error) {
-	// do acme
-	ids := []acme.Identifier{
-		{
-			Type:  "dns",
-			Value: domain.Domain,
-		},
+// NewOrder creates the order of all names of the domain
+func (this *AcmeClient) NewOrder(ctx context.Context, acc *Account, domain *Domain) (acme.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acme.Order{}, err
+	}
+	var ids []acme.Identifier
+	for _, name := range domain.Names() {
+		ids = append(ids, acme.Identifier{
+			Type:  identifierType(name),
+			Value: name,
+		})
 	}
-	order, err := this.client.NewOrder(*acc.acmeAccount, ids)
+	var order acme.Order
+	err := this.rateLimited(ctx, "new order", func(client acme.Client) (err error) {
+		order, err = client.NewOrder(*acc.acmeAccount, ids)
+		return err
+	})
 	if err != nil {
 		logline("new acme order error. err=[", err, "] domain:", domain.Domain, " mail:", domain.AccountMail)
-		return nil, nil, "", err
+		return acme.Order{}, err
+	}
+	return order, nil
+}
+
+// FetchOrder fetches the current state of the order from the CA
+func (this *AcmeClient) FetchOrder(ctx context.Context, acc *Account, orderUrl string) (acme.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acme.Order{}, err
+	}
+	order, err := this.client.FetchOrder(*acc.acmeAccount, orderUrl)
+	if err != nil {
+		logline("fetch order error:", orderUrl, err)
+		return acme.Order{}, err
 	}
+	return order, nil
+}
+
+// FetchAuthorizations fetches all authorizations of the order.
+// The context is checked between acme requests, a running request is not interrupted.
+func (this *AcmeClient) FetchAuthorizations(ctx context.Context, acc *Account, order acme.Order) ([]acme.Authorization, error) {
+	if len(order.Authorizations) == 0 {
+		return nil, errors.New("no authorization")
+	}
+
+	var auths []acme.Authorization
 	for _, authUrl := range order.Authorizations {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		auth, err := this.client.FetchAuthorization(*acc.acmeAccount, authUrl)
 		if err != nil {
 			logline("Error fetching authorization url ", authUrl, ":", err)
-			return nil, nil, "", err
+			return nil, err
+		}
+		auth.URL = authUrl
+		auths = append(auths, auth)
+	}
+	return auths, nil
+}
+
+// AcquireChallenging picks the challenges of the challenge type of the domain from the authorizations.
+// Authorizations already valid at the CA are reused without challenge.
+// Invalid, expired, deactivated and revoked authorizations make the order unusable.
+func AcquireChallenging(auths []acme.Authorization, challengeType string) (chaldata []byte, tokens []string, err error) {
+	acmeChallengeType, ok := acmeChallengeTypes[challengeType]
+	if !ok {
+		return nil, nil, errors.New("unknown challenge type: " + challengeType)
+	}
+
+	var chals []Challenge
+	for _, auth := range auths {
+		switch auth.Status {
+		case AuthorizationValid:
+			logline("reuse valid authorization:", auth.Identifier.Value, "expires:", auth.Expires)
+			continue
+		case AuthorizationPending:
+		default:
+			return nil, nil, &ProblemError{
+				Message: "authorization of " + auth.Identifier.Value + " is " + auth.Status,
+				Problem: authorizationProblem(auth),
+			}
 		}
-		// only use dns challenge
-		chal, ok := auth.ChallengeMap[acme.ChallengeTypeDNS01]
+		chal, ok := auth.ChallengeMap[acmeChallengeType]
 		if !ok {
-			logline("Unable to find dns challenge for auth ", domain.Domain)
+			logline("Unable to find", acmeChallengeType, "challenge for auth ", auth.Identifier.Value)
+			return nil, nil, errors.New("no " + acmeChallengeType + " challenge for " + auth.Identifier.Value)
 		}
+		localChal := challengeConvertLocal(chal)
+		localChal.Identifier = auth.Identifier.Value
+		chals = append(chals, localChal)
+		tokens = append(tokens, chal.Token)
+	}
 
-		j, _ := json.Marshal(challengeConvertLocal(chal))
-		o, _ := json.Marshal(order)
+	j, _ := json.Marshal(chals)
+	return j, tokens, nil
+}
 
-		// current only 1 order
-		return o, j, chal.Token, nil
+// authorizationProblem returns the error of the failed challenge of the authorization
+func authorizationProblem(auth acme.Authorization) acme.Problem {
+	for _, chal := range auth.Challenges {
+		if len(chal.Error.Type) > 0 || len(chal.Error.Detail) > 0 {
+			return chal.Error
+		}
 	}
-
-	return nil, nil, "", errors.New("no authorization")
+	return acme.Problem{}
 }
 
-func (this *AcmeClient) UpdateChallenge(acc *Account, domain *Domain) (privKeyData, certData []byte, err error) {
-	chalLocal := acme.Challenge{}
-	err = json.Unmarshal([]byte(domain.ChallengeData), &chalLocal)
+// UpdateChallenge asks the CA to validate the challenges of the domain.
+// The context is checked between acme requests, a running request is not interrupted.
+func (this *AcmeClient) UpdateChallenge(ctx context.Context, acc *Account, domain *Domain) error {
+	chals, err := domain.challenges()
 	if err != nil {
 		logline("update challenge unmarshal chal failed:", err)
-		return nil, nil, err
+		return err
 	}
-	chal := challengeConvertOrigin(chalLocal)
 
-	newChal, err := this.client.UpdateChallenge(*acc.acmeAccount, chal)
-	if err != nil {
-		logline("acme update challenge error:", err)
-		return nil, nil, err
-	}
-	//TODO need remove
-	logline("new chal is:", newChal)
+	for _, chalLocal := range chals {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chal := challengeConvertOrigin(chalLocal)
 
-	// generate ecdsa certificate
-	privKey, privKeyData, csr, err := GenerateECDSA256Certificate(domain.Domain, []string{})
-	var _ = privKey
-	if err != nil {
-		logline("generate ecdsa 256 certificate error:", err)
-		return nil, nil, err
+		newChal, err := this.client.UpdateChallenge(*acc.acmeAccount, chal)
+		if err != nil {
+			logline("acme update challenge error:", err)
+			return err
+		}
+		switch newChal.Status {
+		case ChallengeValid:
+		case ChallengePending, ChallengeProcessing:
+			// the order stays pending until validation completes
+			logline("challenge is still", newChal.Status+":", chalLocal.Identifier)
+		default:
+			return &ProblemError{
+				Message:    "challenge of " + chalLocal.Identifier + " is " + newChal.Status,
+				Problem:    newChal.Error,
+				Identifier: chalLocal.Identifier,
+			}
+		}
 	}
+	return nil
+}
 
-	order := acme.Order{}
-	err = json.Unmarshal([]byte(domain.OrderData), &order)
-	if err != nil {
-		logline("update challenge unmarshal order failed:", err)
-		return nil, nil, err
+// FinalizeOrder submits the csr of a ready order
+func (this *AcmeClient) FinalizeOrder(ctx context.Context, acc *Account, order acme.Order, csr *x509.CertificateRequest) (acme.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return acme.Order{}, err
 	}
-
-	order, err = this.client.FinalizeOrder(*acc.acmeAccount, order, csr)
+	err := this.rateLimited(ctx, "finalize order", func(client acme.Client) (err error) {
+		order, err = client.FinalizeOrder(*acc.acmeAccount, order, csr)
+		return err
+	})
 	if err != nil {
 		logline("finalize order failed:", err)
-		return nil, nil, err
+		return acme.Order{}, err
+	}
+	return order, nil
+}
+
+// FetchCertificate fetches the certificate of a valid order, leaf certificate first followed by the chain
+func (this *AcmeClient) FetchCertificate(ctx context.Context, acc *Account, order acme.Order) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	certs, err := this.client.FetchCertificates(*acc.acmeAccount, order.Certificate)
 	if err != nil {
 		logline("fetch certificates failed:", err)
-		return nil, nil, err
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate")
 	}
 
 	//TODO need remove
 	logline("cert generated:", certs)
-	// current only 1 cert
-	certPemData := strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certs[0].Raw,
-	})))
-	return privKeyData, []byte(certPemData), nil
+	return []byte(encodeCertificatePem(certs)), nil
 }
 
-func GenerateECDSA256Certificate(domainName string, domainList []string) (privKey *ecdsa.PrivateKey, privKeyData []byte, csr *x509.CertificateRequest, err error) {
+func GenerateECDSA256Key() (privKey *ecdsa.PrivateKey, privKeyData []byte, err error) {
 	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		logline("generate ecdsa 256 private key error:", err)
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 	// encode the new ec private key
 	certKeyEnc, err := x509.MarshalECPrivateKey(certKey)
 	if err != nil {
 		logline("encoding ecdsa 256 private key error:", err)
-		return nil, nil, nil, err
-	}
-
-	tpl := &x509.CertificateRequest{
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
-		PublicKeyAlgorithm: x509.ECDSA,
-		PublicKey:          certKey.Public(),
-		Subject:            pkix.Name{CommonName: domainName},
-		DNSNames:           domainList,
-	}
-	csrDer, err := x509.CreateCertificateRequest(rand.Reader, tpl, certKey)
-	if err != nil {
-		logline("creating certificate error:", err)
-		return nil, nil, nil, err
-	}
-	csr, err = x509.ParseCertificateRequest(csrDer)
-	if err != nil {
-		logline("parsing certificate error:", err)
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
-	return certKey, certKeyEnc, csr, nil
+	return certKey, certKeyEnc, nil
 }
 
-func WritePemPrivateKeyFile(f string, key []byte) error {
-	if err := ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: key,
-	}), 0600); err != nil {
+func WritePemPrivateKeyFile(f string, key crypto.Signer) error {
+	block := &pem.Block{}
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		data, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return err
+		}
+		block.Type = "EC PRIVATE KEY"
+		block.Bytes = data
+	} else {
+		data, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block.Type = "PRIVATE KEY"
+		block.Bytes = data
+	}
+	if err := ioutil.WriteFile(f, pem.EncodeToMemory(block), 0600); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContextTransport(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &http.Client{Transport: &contextTransport{base: http.DefaultTransport, ctx: ctx}}
+
+	// the body can be read after RoundTrip returned
+	resp, err := client.Get(server.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("body = %q, error = %v", body, err)
+	}
+
+	// cancellation interrupts a request in flight
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(server.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("interrupted request succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request is not interrupted")
+	}
+
+	// later requests fail at once
+	_, err = client.Get(server.URL + "/fast")
+	if err == nil {
+		t.Error("request after cancellation succeeded")
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// /api/v2 is a resource api with json bodies. Errors are returned as
+// {"Error": {"Code": ..., "Message": ...}} with a 4xx status for invalid requests.
+
+var ApiV2Prefix = "/api/v2/"
+
+var (
+	ErrorInvalidRequest   = "invalid_request"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorForbidden        = "forbidden"
+	ErrorNotFound         = "not_found"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorConflict         = "conflict"
+	ErrorCaaForbidden     = "caa_forbidden"
+	ErrorInternal         = "internal_error"
+)
+
+// ApiError is an error with the status and code responded by the api
+type ApiError struct {
+	Status  int `json:"-"`
+	Code    string
+	Message string
+}
+
+func (this *ApiError) Error() string {
+	return this.Code + ": " + this.Message
+}
+
+func newApiError(status int, code string, message string) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: message}
+}
+
+// apiV2Handler returns the status and the json body of the response
+type apiV2Handler func(r *http.Request, args []string) (int, interface{}, error)
+
+type apiV2Route struct {
+	Method string
+	// path segments below /api/v2/, "*" matches any segment and is passed to the handler
+	Pattern string
+	Scope   string
+	Handler apiV2Handler
+}
+
+var apiV2Routes = []apiV2Route{
+	{http.MethodGet, "accounts", ScopeAccountsRead, apiListAccounts},
+	{http.MethodPost, "accounts", ScopeAccountsWrite, apiCreateAccount},
+	{http.MethodGet, "accounts/*", ScopeAccountsRead, apiGetAccount},
+	{http.MethodPatch, "accounts/*", ScopeAccountsWrite, apiUpdateAccount},
+	{http.MethodDelete, "accounts/*", ScopeAccountsWrite, apiDeleteAccount},
+	{http.MethodPost, "accounts/*/deactivate", ScopeAccountsWrite, apiDeactivateAccount},
+	{http.MethodGet, "accounts/*/authorizations", ScopeAccountsRead, apiListAuthorizations},
+
+	{http.MethodGet, "domains", ScopeIssuesRead, apiListDomains},
+	{http.MethodPost, "domains", ScopeIssuesWrite, apiCreateDomain},
+	{http.MethodGet, "domains/*", ScopeIssuesRead, apiGetDomain},
+	{http.MethodPatch, "domains/*", ScopeIssuesWrite, apiUpdateDomain},
+	{http.MethodDelete, "domains/*", ScopeAdmin, apiDeleteDomain},
+	{http.MethodPost, "domains/*/retry", ScopeAdmin, apiRetryDomain},
+
+	{http.MethodGet, "certificates", ScopeIssuesRead, apiListCertificates},
+	{http.MethodPost, "certificates", ScopeIssuesWrite, apiImportCertificates},
+	{http.MethodGet, "certificates/*", ScopeIssuesRead, apiGetCertificate},
+
+	{http.MethodGet, "dns-providers", ScopeAdmin, apiListDnsProviders},
+	{http.MethodPost, "dns-providers", ScopeAdmin, apiCreateDnsProvider},
+	{http.MethodDelete, "dns-providers/*", ScopeAdmin, apiDeleteDnsProvider},
+}
+
+// match returns the wildcard segments of the path
+func (this *apiV2Route) match(segments []string) ([]string, bool) {
+	pattern := strings.Split(this.Pattern, "/")
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	var args []string
+	for i, v := range pattern {
+		if v == "*" {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			args = append(args, segments[i])
+		} else if v != segments[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+func httpApiV2(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, ApiV2Prefix), "/"), "/")
+
+	pathFound := false
+	for _, route := range apiV2Routes {
+		args, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		pathFound = true
+		if route.Method != r.Method {
+			continue
+		}
+
+		token, err := authenticate(r)
+		if err != nil {
+			logline("authentication error:", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeApiError(w, newApiError(http.StatusUnauthorized, ErrorUnauthorized, "authentication required"))
+			return
+		}
+		if !token.hasScope(route.Scope) {
+			logline("token", token.Id, "has no scope", route.Scope, "of", r.URL.Path)
+			writeApiError(w, newApiError(http.StatusForbidden, ErrorForbidden, "scope "+route.Scope+" required"))
+			return
+		}
+
+		status, body, err := route.Handler(withPrincipal(r, token), args)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+		writeJson(w, status, body)
+		return
+	}
+
+	if pathFound {
+		writeApiError(w, newApiError(http.StatusMethodNotAllowed, ErrorMethodNotAllowed, r.Method+" is not allowed"))
+		return
+	}
+	writeApiError(w, newApiError(http.StatusNotFound, ErrorNotFound, "no such resource"))
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// writeApiError responds api errors as they are, missing records as 404 and others as 500
+func writeApiError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*ApiError)
+	if !ok {
+		if err == badger.ErrKeyNotFound {
+			apiErr = newApiError(http.StatusNotFound, ErrorNotFound, "record not found")
+		} else {
+			logline("api error:", err)
+			apiErr = newApiError(http.StatusInternalServerError, ErrorInternal, "error occurs.")
+		}
+	}
+	writeJson(w, apiErr.Status, map[string]interface{}{"Error": apiErr})
+}
+
+// decodeJsonBody decodes the request body, unknown fields are rejected
+func decodeJsonBody(r *http.Request, limit int64, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, limit))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return newApiError(http.StatusBadRequest, ErrorInvalidRequest, "illegal json body: "+err.Error())
+	}
+	return nil
+}
+
+// accountView hides the private key of the account
+func accountView(acc *Account) *Account {
+	view := *acc
+	view.PrivateKeyString = ""
+	return &view
+}
+
+// domainView hides the order of the domain, its key and challenge tokens
+func domainView(domain *Domain) *Domain {
+	view := *domain
+	view.OrderPrivateKeyString = ""
+	view.OrderData = ""
+	view.ChallengeData = ""
+	return &view
+}
+
+// certificateView hides the private key of the certificate
+func certificateView(cert *Certificate) *Certificate {
+	view := *cert
+	view.PrivateKeyString = ""
+	return &view
+}
+
+func apiListAccounts(r *http.Request, args []string) (int, interface{}, error) {
+	accounts, err := QueryAllAccount()
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]*Account, 0, len(accounts))
+	for _, v := range accounts {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, accountView(v))
+		}
+	}
+	return http.StatusOK, result, nil
+}
+
+type accountCreateRequest struct {
+	Mail string
+	Name string
+	Ca   string
+	// existing account key in PEM or JWK format, a new account is registered if empty
+	Key string
+}
+
+func apiCreateAccount(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(accountCreateRequest)
+	err := decodeJsonBody(r, 64*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(req.Mail) == 0 || len(req.Name) == 0 {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "mail and name are required")
+	}
+	if config.caProfile(req.Ca) == nil {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "unknown ca profile: "+req.Ca)
+	}
+	if !validAccountMail(req.Mail) {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "mail is illegal: "+req.Mail)
+	}
+	exists, err := AccountExists(requestTenant(r), req.Mail)
+	if err != nil {
+		return 0, nil, err
+	}
+	if exists {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "account exists: "+req.Mail)
+	}
+
+	client, err := caClient(req.Ca)
+	if err != nil {
+		return 0, nil, err
+	}
+	var acc *Account
+	if len(req.Key) > 0 {
+		privKey, err := ParseAccountKey([]byte(req.Key))
+		if err != nil {
+			return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "illegal account key: "+err.Error())
+		}
+		acc, err = client.ImportAccount(r.Context(), privKey, []string{req.Mail})
+		if err != nil {
+			return 0, nil, err
+		}
+	} else {
+		acc, err = client.Register(r.Context(), []string{req.Mail})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	acc.AccountName = req.Name
+	acc.CaName = config.caProfile(req.Ca).Name
+	acc.Tenant = requestTenant(r)
+	err = SaveAccount(req.Mail, acc)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, accountView(acc), nil
+}
+
+func apiGetAccount(r *http.Request, args []string) (int, interface{}, error) {
+	acc, err := tenantAccount(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, accountView(acc), nil
+}
+
+type accountUpdateRequest struct {
+	Contacts []string
+}
+
+func apiUpdateAccount(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(accountUpdateRequest)
+	err := decodeJsonBody(r, 64*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(req.Contacts) == 0 {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "contacts are required")
+	}
+	for _, v := range req.Contacts {
+		if len(v) == 0 {
+			return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "contact is empty")
+		}
+	}
+
+	acc, err := tenantAccount(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	client, err := caClient(acc.CaName)
+	if err != nil {
+		return 0, nil, err
+	}
+	acc, err = client.UpdateContacts(r.Context(), acc, req.Contacts)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = SaveAccount(args[0], acc)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, accountView(acc), nil
+}
+
+func apiDeleteAccount(r *http.Request, args []string) (int, interface{}, error) {
+	_, err := tenantAccount(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	err = DeleteAccount(requestTenant(r), args[0])
+	if err == ErrAccountInUse {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "account is still used by domains")
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+func apiDeactivateAccount(r *http.Request, args []string) (int, interface{}, error) {
+	acc, err := tenantAccount(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	client, err := caClient(acc.CaName)
+	if err != nil {
+		return 0, nil, err
+	}
+	acc, err = client.DeactivateAccount(r.Context(), acc)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = SaveAccount(args[0], acc)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, accountView(acc), nil
+}
+
+func apiListAuthorizations(r *http.Request, args []string) (int, interface{}, error) {
+	_, err := tenantAccount(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	result, err := QueryAuthorizationsByMail(requestTenant(r), args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	if result == nil {
+		result = []*Authorization{}
+	}
+	return http.StatusOK, result, nil
+}
+
+func apiListDomains(r *http.Request, args []string) (int, interface{}, error) {
+	domains, err := QueryAllDomain()
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]*Domain, 0, len(domains))
+	for _, v := range domains {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, domainView(v))
+		}
+	}
+	return http.StatusOK, result, nil
+}
+
+func apiCreateDomain(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(IssueRequest)
+	err := decodeJsonBody(r, 1024*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	domain, err := createIssue(r, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, domainView(domain), nil
+}
+
+func apiGetDomain(r *http.Request, args []string) (int, interface{}, error) {
+	domain, err := tenantDomain(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, domainView(domain), nil
+}
+
+type domainUpdateRequest struct {
+	ReuseKey        *bool
+	KeyRotationDays *int
+}
+
+func apiUpdateDomain(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(domainUpdateRequest)
+	err := decodeJsonBody(r, 64*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if req.KeyRotationDays != nil && *req.KeyRotationDays < 0 {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "key rotation days is negative")
+	}
+
+	domainKey := tenantKey(requestTenant(r), args[0])
+	if !domainLocks.tryLock(domainKey) {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "domain is being processed")
+	}
+	defer domainLocks.unlock(domainKey)
+
+	domain, err := tenantDomain(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	if req.ReuseKey != nil {
+		domain.ReuseKey = *req.ReuseKey
+	}
+	if req.KeyRotationDays != nil {
+		domain.KeyRotationDays = *req.KeyRotationDays
+	}
+	err = UpdateDomainDirect(domain.key(), domain)
+	if err != nil {
+		return 0, nil, err
+	}
+	scheduler.Notify()
+	return http.StatusOK, domainView(domain), nil
+}
+
+func apiDeleteDomain(r *http.Request, args []string) (int, interface{}, error) {
+	domainKey := tenantKey(requestTenant(r), args[0])
+	if !domainLocks.tryLock(domainKey) {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "domain is being processed")
+	}
+	defer domainLocks.unlock(domainKey)
+
+	_, err := tenantDomain(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	err = DeleteDomain(domainKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+func apiRetryDomain(r *http.Request, args []string) (int, interface{}, error) {
+	domainKey := tenantKey(requestTenant(r), args[0])
+	if !domainLocks.tryLock(domainKey) {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "domain is being processed")
+	}
+	defer domainLocks.unlock(domainKey)
+
+	domain, err := tenantDomain(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	if domain.Status != IssueFailed {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "domain is not failed")
+	}
+	domain.Status = IssuePending
+	resetAttempts(domain)
+	err = UpdateDomainDirect(domain.key(), domain)
+	if err != nil {
+		return 0, nil, err
+	}
+	scheduler.Notify()
+	return http.StatusOK, domainView(domain), nil
+}
+
+func apiListCertificates(r *http.Request, args []string) (int, interface{}, error) {
+	certs, err := QueryAllCertificate()
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]*Certificate, 0, len(certs))
+	for _, v := range certs {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, certificateView(v))
+		}
+	}
+	return http.StatusOK, result, nil
+}
+
+type certificateImportRequest struct {
+	Mail string
+	// PEM certificates and private keys
+	Bundle string
+}
+
+func apiImportCertificates(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(certificateImportRequest)
+	err := decodeJsonBody(r, 16*1024*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(req.Mail) == 0 || len(req.Bundle) == 0 {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "mail and bundle are required")
+	}
+	acc, err := tenantAccount(r, req.Mail)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "account not found: "+req.Mail)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if acc.Status == AccountDeactivated {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "account is deactivated: "+req.Mail)
+	}
+	bundle, err := ParseCertificateBundle([]byte(req.Bundle))
+	if err != nil {
+		return 0, nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "illegal certificate bundle: "+err.Error())
+	}
+
+	result := importCertificates(r, req.Mail, bundle)
+	return http.StatusOK, map[string]interface{}{"Results": result}, nil
+}
+
+func apiGetCertificate(r *http.Request, args []string) (int, interface{}, error) {
+	domain, err := tenantDomain(r, args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	cert, err := QueryCertificate(domain.key())
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, certificateView(cert), nil
+}
+
+func apiListDnsProviders(r *http.Request, args []string) (int, interface{}, error) {
+	providers, err := QueryAllDnsProviders()
+	if err != nil {
+		return 0, nil, err
+	}
+	result := make([]*DnsProvider, 0, len(providers))
+	for _, v := range providers {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, dnsProviderView(v))
+		}
+	}
+	return http.StatusOK, result, nil
+}
+
+type dnsProviderCreateRequest struct {
+	Name string
+	Type string
+	// credentials of the type, e.g. key and secret of godaddy
+	Credentials map[string]string
+}
+
+func apiCreateDnsProvider(r *http.Request, args []string) (int, interface{}, error) {
+	req := new(dnsProviderCreateRequest)
+	err := decodeJsonBody(r, 64*1024, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	provider, err := newDnsProvider(requestTenant(r), req.Name, req.Type, req.Credentials)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = SaveDnsProvider(provider)
+	if err == ErrDnsProviderExists {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "dns provider exists: "+req.Name)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, dnsProviderView(provider), nil
+}
+
+func apiDeleteDnsProvider(r *http.Request, args []string) (int, interface{}, error) {
+	err := DeleteDnsProvider(requestTenant(r), args[0])
+	if err == ErrDnsProviderInUse {
+		return 0, nil, newApiError(http.StatusConflict, ErrorConflict, "dns provider is still used by domains")
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestApiV2RouteMatch(t *testing.T) {
+	route := &apiV2Route{Pattern: "accounts/*/authorizations"}
+	paths := map[string][]string{
+		"accounts/ops@example.com/authorizations": {"ops@example.com"},
+		"accounts//authorizations":                nil,
+		"accounts/ops@example.com":                nil,
+		"accounts/ops@example.com/deactivate":     nil,
+		"domains/ops@example.com/authorizations":  nil,
+		"accounts/a/authorizations/extra":         nil,
+	}
+	for path, want := range paths {
+		args, ok := route.match(strings.Split(path, "/"))
+		if ok != (want != nil) {
+			t.Errorf("match of %s: %v, want %v", path, ok, want != nil)
+			continue
+		}
+		if ok && !reflect.DeepEqual(args, want) {
+			t.Errorf("args of %s: %v, want %v", path, args, want)
+		}
+	}
+
+	// patterns without wildcards match without arguments
+	list := &apiV2Route{Pattern: "domains"}
+	if args, ok := list.match([]string{"domains"}); !ok || len(args) != 0 {
+		t.Errorf("match of domains: %v %v", args, ok)
+	}
+}
+
+func TestWriteApiError(t *testing.T) {
+	errs := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{newApiError(http.StatusConflict, ErrorConflict, "domain exists"), http.StatusConflict, ErrorConflict},
+		{newApiError(http.StatusBadRequest, ErrorInvalidRequest, "name is required"), http.StatusBadRequest, ErrorInvalidRequest},
+		{badger.ErrKeyNotFound, http.StatusNotFound, ErrorNotFound},
+		{errors.New("disk failure"), http.StatusInternalServerError, ErrorInternal},
+	}
+	for _, v := range errs {
+		w := httptest.NewRecorder()
+		writeApiError(w, v.err)
+		if w.Code != v.status {
+			t.Errorf("status of %v: %d, want %d", v.err, w.Code, v.status)
+		}
+		var body struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != v.code {
+			t.Errorf("code of %v: %s, want %s", v.err, body.Error.Code, v.code)
+		}
+		if strings.Contains(w.Body.String(), "disk failure") {
+			t.Error("internal error is exposed")
+		}
+	}
+}
+
+func TestHttpApiV2(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{AdminToken: "bootstrap-secret"})
+	_, reader, err := NewApiToken("", "reader", []string{ScopeIssuesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		method     string
+		path       string
+		credential string
+		status     int
+	}{
+		{http.MethodGet, "/api/v2/domains", reader, http.StatusOK},
+		{http.MethodGet, "/api/v2/domains/", reader, http.StatusOK},
+		{http.MethodGet, "/api/v2/domains/www.example.com", reader, http.StatusNotFound},
+		{http.MethodGet, "/api/v2/domains", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/v2/domains/www.example.com/retry", reader, http.StatusForbidden},
+		{http.MethodPut, "/api/v2/domains", reader, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/v2/orders", reader, http.StatusNotFound},
+		{http.MethodGet, "/api/v2/accounts", "bootstrap-secret", http.StatusOK},
+	}
+	for _, v := range requests {
+		r := httptest.NewRequest(v.method, v.path, nil)
+		if len(v.credential) > 0 {
+			r.Header.Set("Authorization", "Bearer "+v.credential)
+		}
+		w := httptest.NewRecorder()
+		httpApiV2(w, r)
+		if w.Code != v.status {
+			t.Errorf("%s %s: status %d, want %d, body %s", v.method, v.path, w.Code, v.status, w.Body.String())
+		}
+	}
+}
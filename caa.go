@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const caaProblemType = "urn:ietf:params:acme:error:caa"
+
+var (
+	dnsTypeCAA       = dnsmessage.Type(257)
+	caaLookupTimeout = 10 * time.Second
+)
+
+// caaRecord is a CAA resource record, rfc8659
+type caaRecord struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (this caaRecord) critical() bool {
+	return this.Flags&0x80 != 0
+}
+
+// checkCaa walks the CAA tree of every name and verifies the CA of the profile may issue for it.
+// CAA is not checked for profiles without issuer domains and for ip addresses.
+func checkCaa(ctx context.Context, domain *Domain, profile *CaProfile, accountUrl string) error {
+	if len(profile.CaaIdentities) == 0 {
+		return nil
+	}
+	for _, name := range domain.Names() {
+		if identifierType(name) == IdentifierIp {
+			continue
+		}
+		records, err := relevantCaaRecords(ctx, strings.TrimPrefix(name, "*."))
+		if err != nil {
+			return err
+		}
+		if !caaPermitted(records, strings.HasPrefix(name, "*."), profile.CaaIdentities, accountUrl, acmeChallengeTypes[domain.ChallengeType]) {
+			return &ProblemError{
+				Message: "caa records forbid issuance by " + profile.Name,
+				Problem: acme.Problem{
+					Type:   caaProblemType,
+					Detail: "no caa record of " + name + " permits " + strings.Join(profile.CaaIdentities, ","),
+				},
+				Identifier: name,
+			}
+		}
+	}
+	return nil
+}
+
+// relevantCaaRecords returns the first non-empty CAA record set climbing from the name to the top label
+func relevantCaaRecords(ctx context.Context, name string) ([]caaRecord, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := range labels {
+		records, err := lookupCaa(ctx, strings.Join(labels[i:], "."))
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+// caaPermitted evaluates the issue or issuewild properties of the record set
+func caaPermitted(records []caaRecord, wildcard bool, issuers []string, accountUrl string, validationMethod string) bool {
+	var issueRecords, issueWildRecords []caaRecord
+	for _, v := range records {
+		switch strings.ToLower(v.Tag) {
+		case "issue":
+			issueRecords = append(issueRecords, v)
+		case "issuewild":
+			issueWildRecords = append(issueWildRecords, v)
+		case "iodef", "issuemail", "issuevmc":
+		default:
+			// unknown critical property forbids any issuance
+			if v.critical() {
+				return false
+			}
+		}
+	}
+
+	relevant := issueRecords
+	if wildcard && len(issueWildRecords) > 0 {
+		relevant = issueWildRecords
+	}
+	if len(relevant) == 0 {
+		return true
+	}
+	for _, v := range relevant {
+		if caaValuePermitted(v.Value, issuers, accountUrl, validationMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// caaValuePermitted matches "issuer-domain; accounturi=...; validationmethods=..." against the CA
+func caaValuePermitted(value string, issuers []string, accountUrl string, validationMethod string) bool {
+	parts := strings.Split(value, ";")
+	issuer := strings.ToLower(strings.TrimSpace(parts[0]))
+	matched := false
+	for _, v := range issuers {
+		if issuer == strings.ToLower(v) {
+			matched = true
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	for _, v := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "accounturi":
+			if strings.TrimSpace(kv[1]) != accountUrl {
+				return false
+			}
+		case "validationmethods":
+			found := false
+			for _, method := range strings.Split(kv[1], ",") {
+				if strings.TrimSpace(method) == validationMethod {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lookupCaa queries the CAA records of the name from the configured resolver.
+// The resolver follows aliases, so all CAA records of the answer are relevant.
+func lookupCaa(ctx context.Context, name string) ([]caaRecord, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: dnsTypeCAA, Class: dnsmessage.ClassINET},
+		},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := config.caaResolver()
+	resp, err := dnsExchange(ctx, "udp", resolver, query)
+	if err != nil {
+		return nil, err
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if header.Truncated {
+		resp, err = dnsExchange(ctx, "tcp", resolver, query)
+		if err != nil {
+			return nil, err
+		}
+		header, err = parser.Start(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.ID != msg.Header.ID {
+		return nil, errors.New("dns response id mismatch: " + name)
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		// issuance must not proceed when the CAA records can not be retrieved
+		return nil, errors.New("caa lookup of " + name + " failed: " + header.RCode.String())
+	}
+
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	var records []caaRecord
+	for {
+		h, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Type != dnsTypeCAA {
+			err = parser.SkipAnswer()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rr, err := parser.UnknownResource()
+		if err != nil {
+			return nil, err
+		}
+		record, err := parseCaaData(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func parseCaaData(data []byte) (caaRecord, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return caaRecord{}, errors.New("illegal caa record")
+	}
+	tagLen := int(data[1])
+	return caaRecord{
+		Flags: data[0],
+		Tag:   string(data[2 : 2+tagLen]),
+		Value: string(data[2+tagLen:]),
+	}, nil
+}
+
+func dnsExchange(ctx context.Context, network string, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, caaLookupTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		_, err = conn.Write(query)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// dns over tcp is prefixed by the message length
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(query)))
+	_, err = conn.Write(append(lenBuf, query...))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(conn, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf
+func systemResolver() string {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// checkCaaAccounts rejects the domain when CAA records forbid the CAs of all its accounts.
+// Lookup errors are left to the check before ordering.
+func checkCaaAccounts(ctx context.Context, domain *Domain) error {
+	var caaErr error
+	for _, mail := range domain.AccountList {
+		acc, err := QueryAccountByMail(domain.Tenant, mail)
+		if err != nil {
+			return err
+		}
+		profile := config.caProfile(acc.CaName)
+		if profile == nil {
+			continue
+		}
+		err = checkCaa(ctx, domain, profile, acc.AccountUrl)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*ProblemError); !ok {
+			logline("caa check error:", domain.Domain, err)
+			return nil
+		}
+		caaErr = err
+	}
+	return caaErr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/eggsampler/acme"
+)
+
+func TestCaaPermitted(t *testing.T) {
+	issuers := []string{"letsencrypt.org"}
+	accountUrl := "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+
+	tests := map[string]struct {
+		records   []caaRecord
+		wildcard  bool
+		permitted bool
+	}{
+		"no records":                        {nil, false, true},
+		"issue of the ca":                   {[]caaRecord{{Tag: "issue", Value: "letsencrypt.org"}}, false, true},
+		"issue of the ca in upper case":     {[]caaRecord{{Tag: "ISSUE", Value: "LetsEncrypt.org"}}, false, true},
+		"issue of other ca":                 {[]caaRecord{{Tag: "issue", Value: "pki.goog"}}, false, false},
+		"one of issue records":              {[]caaRecord{{Tag: "issue", Value: "pki.goog"}, {Tag: "issue", Value: "letsencrypt.org"}}, false, true},
+		"issue of nobody":                   {[]caaRecord{{Tag: "issue", Value: ";"}}, false, false},
+		"only iodef":                        {[]caaRecord{{Tag: "iodef", Value: "mailto:caa@example.com"}}, false, true},
+		"unknown property":                  {[]caaRecord{{Tag: "future", Value: "x"}}, false, true},
+		"unknown critical property":         {[]caaRecord{{Flags: 0x80, Tag: "future", Value: "x"}, {Tag: "issue", Value: "letsencrypt.org"}}, false, false},
+		"known critical property":           {[]caaRecord{{Flags: 0x80, Tag: "issue", Value: "letsencrypt.org"}}, false, true},
+		"critical iodef":                    {[]caaRecord{{Flags: 0x80, Tag: "iodef", Value: "mailto:caa@example.com"}}, false, true},
+		"other flags are not critical":      {[]caaRecord{{Flags: 0x01, Tag: "future", Value: "x"}}, false, true},
+		"wildcard by issue":                 {[]caaRecord{{Tag: "issue", Value: "letsencrypt.org"}}, true, true},
+		"wildcard forbidden by issue":       {[]caaRecord{{Tag: "issue", Value: "pki.goog"}}, true, false},
+		"wildcard by issuewild":             {[]caaRecord{{Tag: "issue", Value: "pki.goog"}, {Tag: "issuewild", Value: "letsencrypt.org"}}, true, true},
+		"wildcard forbidden by issuewild":   {[]caaRecord{{Tag: "issue", Value: "letsencrypt.org"}, {Tag: "issuewild", Value: ";"}}, true, false},
+		"issuewild ignored for other names": {[]caaRecord{{Tag: "issue", Value: "letsencrypt.org"}, {Tag: "issuewild", Value: ";"}}, false, true},
+		"only issuewild for other names":    {[]caaRecord{{Tag: "issuewild", Value: "pki.goog"}}, false, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := caaPermitted(test.records, test.wildcard, issuers, accountUrl, acme.ChallengeTypeDNS01)
+			if got != test.permitted {
+				t.Errorf("caaPermitted = %v, want %v", got, test.permitted)
+			}
+		})
+	}
+}
+
+func TestCaaValuePermitted(t *testing.T) {
+	issuers := []string{"letsencrypt.org", "pki.goog"}
+	accountUrl := "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+
+	cases := []struct {
+		value     string
+		method    string
+		permitted bool
+	}{
+		{"letsencrypt.org", acme.ChallengeTypeHTTP01, true},
+		{" pki.goog ", acme.ChallengeTypeHTTP01, true},
+		{"example.net", acme.ChallengeTypeHTTP01, false},
+		{"", acme.ChallengeTypeHTTP01, false},
+		{"letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/1", acme.ChallengeTypeHTTP01, true},
+		{"letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/2", acme.ChallengeTypeHTTP01, false},
+		{"letsencrypt.org; AccountURI = https://acme-v02.api.letsencrypt.org/acme/acct/1", acme.ChallengeTypeHTTP01, true},
+		{"letsencrypt.org; validationmethods=dns-01", acme.ChallengeTypeDNS01, true},
+		{"letsencrypt.org; validationmethods=dns-01", acme.ChallengeTypeHTTP01, false},
+		{"letsencrypt.org; validationmethods=dns-01, http-01", acme.ChallengeTypeHTTP01, true},
+		{"letsencrypt.org; validationmethods=dns-01,tls-alpn-01", acme.ChallengeTypeTLSALPN01, true},
+		{"letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/1; validationmethods=http-01", acme.ChallengeTypeHTTP01, true},
+		{"letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/1; validationmethods=http-01", acme.ChallengeTypeDNS01, false},
+		{"letsencrypt.org; unknown=x", acme.ChallengeTypeHTTP01, true},
+		{"letsencrypt.org; malformed", acme.ChallengeTypeHTTP01, true},
+	}
+	for _, c := range cases {
+		got := caaValuePermitted(c.value, issuers, accountUrl, c.method)
+		if got != c.permitted {
+			t.Errorf("caaValuePermitted(%q, %s) = %v, want %v", c.value, c.method, got, c.permitted)
+		}
+	}
+}
+
+func TestParseCaaData(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want caaRecord
+		ok   bool
+	}{
+		{append([]byte{0, 5}, "issueletsencrypt.org"...), caaRecord{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}, true},
+		{append([]byte{128, 9}, "issuewild;"...), caaRecord{Flags: 128, Tag: "issuewild", Value: ";"}, true},
+		{append([]byte{0, 5}, "issue"...), caaRecord{Tag: "issue"}, true},
+		{[]byte{0}, caaRecord{}, false},
+		{append([]byte{0, 9}, "issue"...), caaRecord{}, false},
+	}
+	for _, c := range cases {
+		got, err := parseCaaData(c.data)
+		if (err == nil) != c.ok {
+			t.Errorf("parseCaaData(%q) error = %v, want ok %v", c.data, err, c.ok)
+			continue
+		}
+		if c.ok && got != c.want {
+			t.Errorf("parseCaaData(%q) = %+v, want %+v", c.data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	CertificateIssued   = "issued"
+	CertificateImported = "imported"
+)
+
+// CertFilePath is the stable path of the current certificate of the domain
+func CertFilePath(domain *Domain) (string, error) {
+	return outputPath(domain, ".cert")
+}
+
+// renew certificates within this duration before expiry
+var renewBefore = 30 * 24 * time.Hour
+
+// Certificate is the current certificate of a domain
+type Certificate struct {
+	Tenant       string
+	Domain       string
+	SerialNumber string
+	Issuer       string
+	Source       string
+
+	// CA profile and account of issued certificates
+	CaName      string
+	AccountMail string
+
+	NotBefore string
+	NotAfter  string
+
+	// leaf certificate first, followed by the chain
+	CertificatePem   string
+	PrivateKeyString string
+}
+
+// ImportedCertificate is a certificate with its private key found in an import bundle
+type ImportedCertificate struct {
+	Leaf       *x509.Certificate
+	Chain      []*x509.Certificate
+	PrivateKey crypto.Signer
+}
+
+// ParseCertificateBundle pairs every certificate in the PEM data with its private key.
+// Certificates without a private key in the data are treated as chain certificates.
+func ParseCertificateBundle(data []byte) ([]*ImportedCertificate, error) {
+	var certs []*x509.Certificate
+	var keys []crypto.Signer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+			continue
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key, err := parsePemPrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	var result []*ImportedCertificate
+	for _, key := range keys {
+		pub, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		var leaf *x509.Certificate
+		for _, cert := range certs {
+			if bytes.Equal(cert.RawSubjectPublicKeyInfo, pub) {
+				leaf = cert
+				break
+			}
+		}
+		if leaf == nil {
+			return nil, errors.New("no certificate found for private key")
+		}
+		result = append(result, &ImportedCertificate{
+			Leaf:       leaf,
+			Chain:      issuerChain(leaf, certs),
+			PrivateKey: key,
+		})
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no certificate with private key found")
+	}
+	return result, nil
+}
+
+func issuerChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	var chain []*x509.Certificate
+	cur := leaf
+	for len(chain) < len(certs) {
+		var issuer *x509.Certificate
+		for _, cert := range certs {
+			if cert != cur && bytes.Equal(cert.RawSubject, cur.RawIssuer) && cur.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil || bytes.Equal(issuer.RawSubject, issuer.RawIssuer) {
+			break
+		}
+		chain = append(chain, issuer)
+		cur = issuer
+	}
+	return chain
+}
+
+// certificateNames returns the main domain and the other names of the certificate
+func certificateNames(cert *x509.Certificate) (string, []string, error) {
+	names := append([]string{}, cert.DNSNames...)
+	for _, v := range cert.IPAddresses {
+		names = append(names, v.String())
+	}
+	if len(names) == 0 {
+		return "", nil, errors.New("certificate has no dns names or ip addresses")
+	}
+	main := names[0]
+	for _, v := range names {
+		if v == cert.Subject.CommonName {
+			main = v
+			break
+		}
+	}
+	var altNames []string
+	for _, v := range names {
+		if v != main {
+			altNames = append(altNames, v)
+		}
+	}
+	return main, altNames, nil
+}
+
+func encodeCertificatePem(certs []*x509.Certificate) string {
+	var certPemData []string
+	for _, cert := range certs {
+		certPemData = append(certPemData, strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		}))))
+	}
+	return strings.Join(certPemData, "\n")
+}
+
+// NewCertificateRecord builds the certificate record from the leaf first pem data
+func NewCertificateRecord(domain string, source string, certPem []byte, privKeyString string) (*Certificate, error) {
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{
+		Domain:       domain,
+		SerialNumber: leaf.SerialNumber.Text(16),
+		Issuer:       leaf.Issuer.String(),
+		Source:       source,
+
+		NotBefore: leaf.NotBefore.Format(time.RFC3339Nano),
+		NotAfter:  leaf.NotAfter.Format(time.RFC3339Nano),
+
+		CertificatePem:   string(certPem),
+		PrivateKeyString: privKeyString,
+	}, nil
+}
+
+// needRenew checks whether the certificate of an available domain is going to expire
+func needRenew(domain *Domain) bool {
+	if len(domain.ExpireTime) == 0 {
+		return false
+	}
+	expireTime, err := time.Parse(time.RFC3339Nano, domain.ExpireTime)
+	if err != nil {
+		logline("parse expire time error:", domain.Domain, err)
+		return false
+	}
+	return time.Now().Add(renewBefore).After(expireTime)
+}
+
+func parseCertificateRequest(csrPem string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPem))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// validateCsrNames checks that the csr requests exactly the given names
+func validateCsrNames(csrPem string, names []string) error {
+	csr, err := parseCertificateRequest(csrPem)
+	if err != nil {
+		return err
+	}
+
+	csrNames := make(map[string]bool)
+	for _, v := range csr.DNSNames {
+		csrNames[strings.ToLower(v)] = true
+	}
+	for _, v := range csr.IPAddresses {
+		csrNames[v.String()] = true
+	}
+	if len(csr.Subject.CommonName) > 0 {
+		csrNames[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+
+	requested := make(map[string]bool)
+	for _, v := range names {
+		if ip := net.ParseIP(v); ip != nil {
+			requested[ip.String()] = true
+		} else {
+			requested[strings.ToLower(v)] = true
+		}
+	}
+
+	for v := range requested {
+		if !csrNames[v] {
+			return errors.New("name is not in csr: " + v)
+		}
+	}
+	for v := range csrNames {
+		if !requested[v] {
+			return errors.New("csr name is not requested: " + v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eggsampler/acme"
+)
+
+var (
+	http01PathPrefix = "/.well-known/acme-challenge/"
+	// alpn protocol of tls-alpn-01 validation, rfc8737
+	tlsAlpn01Protocol = "acme-tls/1"
+	// id-pe-acmeIdentifier, rfc8737
+	oidAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+)
+
+var challengeIndexes = &challengeIndex{
+	domains:     make(map[string][]Challenge),
+	tokens:      make(map[string]Challenge),
+	identifiers: make(map[string]Challenge),
+}
+
+// challengeIndex holds the http-01 and tls-alpn-01 challenges of challenging domains,
+// so that validation requests are answered without reading the database.
+// It is updated whenever a domain is saved.
+type challengeIndex struct {
+	lock sync.RWMutex
+	// indexed challenges by the tenant key of the domain
+	domains map[string][]Challenge
+	// http-01 challenges by token
+	tokens map[string]Challenge
+	// tls-alpn-01 challenges by identifier
+	identifiers map[string]Challenge
+}
+
+func (this *challengeIndex) update(domain *Domain) {
+	var chals []Challenge
+	if domain.Status == IssueChallenging {
+		var err error
+		chals, err = domain.challenges()
+		if err != nil {
+			logline("unmarshal challenges error:", domain.Domain, err)
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeLocked(domain.key())
+	var indexed []Challenge
+	for _, chal := range chals {
+		switch chal.Type {
+		case acme.ChallengeTypeHTTP01:
+			this.tokens[chal.Token] = chal
+		case acme.ChallengeTypeTLSALPN01:
+			this.identifiers[chal.Identifier] = chal
+		default:
+			continue
+		}
+		indexed = append(indexed, chal)
+	}
+	if len(indexed) > 0 {
+		this.domains[domain.key()] = indexed
+	}
+}
+
+// remove drops the challenges of the domain given by its tenant key
+func (this *challengeIndex) remove(domainKey string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeLocked(domainKey)
+}
+
+func (this *challengeIndex) removeLocked(domainKey string) {
+	// identifiers may be indexed again by the order of another domain meanwhile
+	for _, chal := range this.domains[domainKey] {
+		if v, ok := this.tokens[chal.Token]; ok && v.URL == chal.URL {
+			delete(this.tokens, chal.Token)
+		}
+		if v, ok := this.identifiers[chal.Identifier]; ok && v.URL == chal.URL {
+			delete(this.identifiers, chal.Identifier)
+		}
+	}
+	delete(this.domains, domainKey)
+}
+
+func (this *challengeIndex) http01(token string) (Challenge, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	chal, ok := this.tokens[token]
+	return chal, ok
+}
+
+func (this *challengeIndex) tlsAlpn01(identifier string) (Challenge, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	chal, ok := this.identifiers[identifier]
+	return chal, ok
+}
+
+// loadChallengeIndex indexes the challenges of all domains, called before serving validation requests
+func loadChallengeIndex() error {
+	domains, err := QueryAllDomain()
+	if err != nil {
+		return err
+	}
+	for _, v := range domains {
+		challengeIndexes.update(v)
+	}
+	return nil
+}
+
+// httpHttp01Challenge responds the key authorization of http-01 challenges
+func httpHttp01Challenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, http01PathPrefix)
+	if len(token) == 0 || strings.Contains(token, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	chal, ok := challengeIndexes.http01(token)
+	if !ok {
+		logline("http-01 challenge not found:", token)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(chal.KeyAuthorization))
+}
+
+func newHttp01Server(laddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(http01PathPrefix, httpHttp01Challenge)
+	return &http.Server{
+		Addr:    laddr,
+		Handler: mux,
+	}
+}
+
+func newTlsAlpn01Server(laddr string) *http.Server {
+	return &http.Server{
+		Addr: laddr,
+		TLSConfig: &tls.Config{
+			NextProtos:     []string{tlsAlpn01Protocol},
+			GetCertificate: tlsAlpn01Certificate,
+		},
+		// the validation finishes within the handshake
+		Handler: http.NotFoundHandler(),
+	}
+}
+
+// tlsAlpn01Certificate creates the validation certificate of the identifier in the server name
+func tlsAlpn01Certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	acmeTls := false
+	for _, v := range hello.SupportedProtos {
+		if v == tlsAlpn01Protocol {
+			acmeTls = true
+		}
+	}
+	if !acmeTls {
+		return nil, errors.New("not a tls-alpn-01 validation request")
+	}
+
+	identifier := reverseDnsAddress(strings.ToLower(hello.ServerName))
+	chal, ok := challengeIndexes.tlsAlpn01(identifier)
+	if !ok {
+		logline("tls-alpn-01 challenge not found:", identifier)
+		return nil, errors.New("challenge not found")
+	}
+	return newTlsAlpn01Certificate(identifier, chal.KeyAuthorization)
+}
+
+func newTlsAlpn01Certificate(identifier string, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "autocert tls-alpn-01"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidAcmeIdentifier, Critical: true, Value: extValue},
+		},
+	}
+	if ip := net.ParseIP(identifier); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{identifier}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// reverseDnsAddress maps the reverse dns name sent as server name for ip identifiers back to the address, rfc8738
+func reverseDnsAddress(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return name
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		if ip := net.ParseIP(strings.Join(labels, ".")); ip != nil {
+			return ip.String()
+		}
+		return name
+	}
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return name
+		}
+		var sb strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			sb.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				sb.WriteString(":")
+			}
+		}
+		if ip := net.ParseIP(sb.String()); ip != nil {
+			return ip.String()
+		}
+		return name
+	}
+	return name
+}
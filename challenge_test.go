@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eggsampler/acme"
+)
+
+func TestReverseDnsAddress(t *testing.T) {
+	ip6Reverse := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"1.2.0.192.in-addr.arpa", "192.0.2.1"},
+		{"1.2.0.192.in-addr.arpa.", "192.0.2.1"},
+		{ip6Reverse, "2001:db8::1"},
+		{ip6Reverse + ".", "2001:db8::1"},
+		// other names are kept
+		{"example.com", "example.com"},
+		{"2.0.192.in-addr.arpa", "2.0.192.in-addr.arpa"},
+		{"1.2.0.300.in-addr.arpa", "1.2.0.300.in-addr.arpa"},
+		{"a.b.c.d.in-addr.arpa", "a.b.c.d.in-addr.arpa"},
+		{"8.b.d.0.1.0.0.2.ip6.arpa", "8.b.d.0.1.0.0.2.ip6.arpa"},
+		{"x" + ip6Reverse[1:], "x" + ip6Reverse[1:]},
+	}
+	for _, test := range tests {
+		if got := reverseDnsAddress(test.name); got != test.want {
+			t.Errorf("reverseDnsAddress(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func challengingDomain(t *testing.T, name string, chals ...Challenge) *Domain {
+	data, err := json.Marshal(chals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Domain{Domain: name, Status: IssueChallenging, ChallengeData: string(data)}
+}
+
+func TestChallengeIndex(t *testing.T) {
+	index := &challengeIndex{
+		domains:     make(map[string][]Challenge),
+		tokens:      make(map[string]Challenge),
+		identifiers: make(map[string]Challenge),
+	}
+	http01 := Challenge{Type: acme.ChallengeTypeHTTP01, URL: "https://ca/chal/1", Token: "token-1", Identifier: "example.com"}
+	tlsAlpn01 := Challenge{Type: acme.ChallengeTypeTLSALPN01, URL: "https://ca/chal/2", Token: "token-2", Identifier: "www.example.com"}
+	dns01 := Challenge{Type: acme.ChallengeTypeDNS01, URL: "https://ca/chal/3", Token: "token-3", Identifier: "mail.example.com"}
+
+	domain := challengingDomain(t, "example.com", http01, tlsAlpn01, dns01)
+	index.update(domain)
+	if chal, ok := index.http01("token-1"); !ok || chal.URL != http01.URL {
+		t.Errorf("http-01 challenge not indexed: %+v", chal)
+	}
+	if chal, ok := index.tlsAlpn01("www.example.com"); !ok || chal.URL != tlsAlpn01.URL {
+		t.Errorf("tls-alpn-01 challenge not indexed: %+v", chal)
+	}
+	if _, ok := index.http01("token-3"); ok {
+		t.Error("dns-01 challenge is indexed")
+	}
+
+	// another domain ordering the same identifier takes it over
+	other := challengingDomain(t, "www.example.com", Challenge{Type: acme.ChallengeTypeTLSALPN01, URL: "https://ca/chal/4", Identifier: "www.example.com"})
+	index.update(other)
+	domain.Status = IssueAvailable
+	index.update(domain)
+	if _, ok := index.http01("token-1"); ok {
+		t.Error("challenge of finished domain is still indexed")
+	}
+	if chal, ok := index.tlsAlpn01("www.example.com"); !ok || chal.URL != "https://ca/chal/4" {
+		t.Errorf("challenge of other domain is removed: %+v", chal)
+	}
+
+	index.remove("www.example.com")
+	if _, ok := index.tlsAlpn01("www.example.com"); ok || len(index.domains) != 0 {
+		t.Error("challenges of deleted domain are still indexed")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// runCommand runs the sub command given on the command line.
+// It returns false when no sub command is given and the server should be started.
+func runCommand(args []string) bool {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "import-account":
+		err = cmdImportAccount(args[1:])
+	default:
+		err = errors.New("unknown command: " + args[0])
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// cmdImportAccount sends an existing account key to a running server.
+// The key is read from a PEM/JWK file or from a certbot account directory.
+func cmdImportAccount(args []string) error {
+	fs := flag.NewFlagSet("import-account", flag.ExitOnError)
+	server := fs.String("server", "http://127.0.0.1:8085", "address of the autocert server")
+	mail := fs.String("mail", "", "mail of the account")
+	name := fs.String("name", "", "name of the account")
+	keyFile := fs.String("key", "", "account key file in PEM or JWK format")
+	certbotDir := fs.String("certbot", "", "certbot account directory")
+	token := fs.String("token", os.Getenv("AUTOCERT_TOKEN"), "api token granted accounts:write")
+	_ = fs.Parse(args)
+
+	if len(*mail) == 0 || len(*name) == 0 {
+		return errors.New("mail and name are required")
+	}
+
+	var keyData []byte
+	var err error
+	switch {
+	case len(*keyFile) > 0:
+		keyData, err = ioutil.ReadFile(*keyFile)
+	case len(*certbotDir) > 0:
+		keyData, err = ReadCertbotAccountKey(*certbotDir)
+	default:
+		return errors.New("one of key and certbot is required")
+	}
+	if err != nil {
+		return err
+	}
+	// validate locally before sending
+	_, err = ParseAccountKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("mail", *mail)
+	q.Set("name", *name)
+	req, err := http.NewRequest(http.MethodPost, *server+"/import_account?"+q.Encode(), bytes.NewReader(keyData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import account failed: %d %s", resp.StatusCode, string(body))
+	}
+	fmt.Println(string(body))
+	return nil
+}
@@ -0,0 +1,267 @@
+// Package client is the Go client of the autocert /api/v2 api described in openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the api of an autocert server with a bearer token
+type Client struct {
+	baseUrl    string
+	token      string
+	httpClient *http.Client
+}
+
+// New creates a client of the server at baseUrl, e.g. "http://127.0.0.1:8085".
+// A nil httpClient uses http.DefaultClient, configure its transport for client certificates.
+func New(baseUrl string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// Error is the error object of the api
+type Error struct {
+	StatusCode int `json:"-"`
+	Code       string
+	Message    string
+}
+
+func (this *Error) Error() string {
+	return fmt.Sprintf("autocert: %d %s: %s", this.StatusCode, this.Code, this.Message)
+}
+
+// IsNotFound checks whether the error is a missing record
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict checks whether the error is a conflict with the current state
+func IsConflict(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+func (this *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, this.baseUrl+"/api/v2/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(this.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+this.token)
+	}
+
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		errBody := struct {
+			Error *Error
+		}{}
+		if json.Unmarshal(data, &errBody) != nil || errBody.Error == nil {
+			return &Error{StatusCode: resp.StatusCode, Code: "unknown", Message: string(data)}
+		}
+		errBody.Error.StatusCode = resp.StatusCode
+		return errBody.Error
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func escape(segment string) string {
+	return url.PathEscape(segment)
+}
+
+// ListAccounts returns the accounts of the tenant
+func (this *Client) ListAccounts(ctx context.Context) ([]*Account, error) {
+	var result []*Account
+	err := this.do(ctx, http.MethodGet, "accounts", nil, &result)
+	return result, err
+}
+
+// CreateAccount registers a new account, or imports an existing one when the key is given
+func (this *Client) CreateAccount(ctx context.Context, req *AccountCreateRequest) (*Account, error) {
+	result := new(Account)
+	err := this.do(ctx, http.MethodPost, "accounts", req, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *Client) GetAccount(ctx context.Context, mail string) (*Account, error) {
+	result := new(Account)
+	err := this.do(ctx, http.MethodGet, "accounts/"+escape(mail), nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateAccountContacts replaces the contact mails of the account
+func (this *Client) UpdateAccountContacts(ctx context.Context, mail string, contacts []string) (*Account, error) {
+	result := new(Account)
+	err := this.do(ctx, http.MethodPatch, "accounts/"+escape(mail), &AccountUpdateRequest{Contacts: contacts}, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeactivateAccount deactivates the account at the CA. This can not be undone.
+func (this *Client) DeactivateAccount(ctx context.Context, mail string) (*Account, error) {
+	result := new(Account)
+	err := this.do(ctx, http.MethodPost, "accounts/"+escape(mail)+"/deactivate", nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteAccount deletes an account not used by any domain
+func (this *Client) DeleteAccount(ctx context.Context, mail string) error {
+	return this.do(ctx, http.MethodDelete, "accounts/"+escape(mail), nil, nil)
+}
+
+func (this *Client) ListAuthorizations(ctx context.Context, mail string) ([]*Authorization, error) {
+	var result []*Authorization
+	err := this.do(ctx, http.MethodGet, "accounts/"+escape(mail)+"/authorizations", nil, &result)
+	return result, err
+}
+
+// ListDomains returns the domains of the tenant
+func (this *Client) ListDomains(ctx context.Context) ([]*Domain, error) {
+	var result []*Domain
+	err := this.do(ctx, http.MethodGet, "domains", nil, &result)
+	return result, err
+}
+
+// CreateDomain requests a certificate, it is issued in the background
+func (this *Client) CreateDomain(ctx context.Context, req *IssueRequest) (*Domain, error) {
+	result := new(Domain)
+	err := this.do(ctx, http.MethodPost, "domains", req, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *Client) GetDomain(ctx context.Context, domain string) (*Domain, error) {
+	result := new(Domain)
+	err := this.do(ctx, http.MethodGet, "domains/"+escape(domain), nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateDomain updates the key policy of the domain, nil fields are kept
+func (this *Client) UpdateDomain(ctx context.Context, domain string, req *DomainUpdateRequest) (*Domain, error) {
+	result := new(Domain)
+	err := this.do(ctx, http.MethodPatch, "domains/"+escape(domain), req, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteDomain deletes the domain with its certificate, the admin scope is required
+func (this *Client) DeleteDomain(ctx context.Context, domain string) error {
+	return this.do(ctx, http.MethodDelete, "domains/"+escape(domain), nil, nil)
+}
+
+// RetryDomain retries a failed domain, the admin scope is required
+func (this *Client) RetryDomain(ctx context.Context, domain string) (*Domain, error) {
+	result := new(Domain)
+	err := this.do(ctx, http.MethodPost, "domains/"+escape(domain)+"/retry", nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListCertificates returns the current certificates of the tenant without private keys
+func (this *Client) ListCertificates(ctx context.Context) ([]*Certificate, error) {
+	var result []*Certificate
+	err := this.do(ctx, http.MethodGet, "certificates", nil, &result)
+	return result, err
+}
+
+// GetCertificate downloads the current certificate of the domain, the chain included
+func (this *Client) GetCertificate(ctx context.Context, domain string) (*Certificate, error) {
+	result := new(Certificate)
+	err := this.do(ctx, http.MethodGet, "certificates/"+escape(domain), nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ImportCertificates imports PEM certificates with their private keys for renewal by the account.
+// It returns the result of every certificate.
+func (this *Client) ImportCertificates(ctx context.Context, mail string, bundlePem string) ([]string, error) {
+	result := new(ImportResult)
+	err := this.do(ctx, http.MethodPost, "certificates", &CertificateImportRequest{Mail: mail, Bundle: bundlePem}, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// ListDnsProviders returns the dns providers of the tenant without credentials, the admin scope is required
+func (this *Client) ListDnsProviders(ctx context.Context) ([]*DnsProvider, error) {
+	var result []*DnsProvider
+	err := this.do(ctx, http.MethodGet, "dns-providers", nil, &result)
+	return result, err
+}
+
+// CreateDnsProvider stores the credentials of a dns api publishing the records of dns challenges.
+// Existing providers are not overwritten, the admin scope is required.
+func (this *Client) CreateDnsProvider(ctx context.Context, req *DnsProviderCreateRequest) (*DnsProvider, error) {
+	result := new(DnsProvider)
+	err := this.do(ctx, http.MethodPost, "dns-providers", req, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteDnsProvider deletes a dns provider not used by any domain, the admin scope is required
+func (this *Client) DeleteDnsProvider(ctx context.Context, name string) error {
+	return this.do(ctx, http.MethodDelete, "dns-providers/"+escape(name), nil, nil)
+}
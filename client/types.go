@@ -0,0 +1,156 @@
+package client
+
+// The types mirror the json of the server records, see openapi.json
+
+type Account struct {
+	AccountUrl  string
+	AccountName string
+	MailList    []string
+	Status      string
+	CaName      string
+	Tenant      string
+}
+
+type AccountCreateRequest struct {
+	Mail string
+	Name string
+	// CA profile, empty for the default
+	Ca string
+	// existing account key in PEM or JWK format, a new account is registered if empty
+	Key string `json:",omitempty"`
+}
+
+type AccountUpdateRequest struct {
+	Contacts []string
+}
+
+type Authorization struct {
+	Tenant      string
+	AccountMail string
+	Identifier  string
+	Url         string
+	Status      string
+	Expires     string
+	UpdateTime  string
+}
+
+type CsrOptions struct {
+	MustStaple     bool
+	OmitCommonName bool
+
+	Organization       []string
+	OrganizationalUnit []string
+	Country            []string
+	Province           []string
+	Locality           []string
+}
+
+type IssueRequest struct {
+	Domain   string
+	AltNames []string
+	Mail     string
+	Fallback []string
+	// dns, http or tls-alpn
+	Challenge string
+	// dns provider of the tenant publishing the records of dns challenges, empty for records managed by hand
+	DnsProvider string `json:",omitempty"`
+	// PEM CSR, the private key stays with the requester
+	Csr        string
+	CsrOptions CsrOptions
+
+	ReuseKey        bool
+	KeyRotationDays int
+}
+
+type DomainUpdateRequest struct {
+	ReuseKey        *bool `json:",omitempty"`
+	KeyRotationDays *int  `json:",omitempty"`
+}
+
+var (
+	DomainPending     = "pending"
+	DomainChallenging = "challenging"
+	DomainAvailable   = "available"
+	DomainFailed      = "failed"
+)
+
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+type Domain struct {
+	Tenant        string
+	Domain        string
+	AltNames      []string
+	AccountMail   string
+	AccountList   []string
+	ChallengeType string
+	DnsProvider   string
+	Status        string
+
+	CreateTime    string
+	ChallengeTime string
+	IssueTime     string
+	ExpireTime    string
+	// next lookup of dns-01 records not yet propagated
+	PropagationCheckTime string
+
+	Attempts        int
+	LastError       string
+	LastProblem     *Problem
+	NextAttemptTime string
+
+	CsrPem     string
+	CsrOptions CsrOptions
+
+	ReuseKey        bool
+	KeyRotationDays int
+	KeyCreateTime   string
+
+	OcspRefreshTime string
+	Revoked         bool
+
+	OrderUrl string
+}
+
+type Certificate struct {
+	Tenant       string
+	Domain       string
+	SerialNumber string
+	Issuer       string
+	// issued or imported
+	Source      string
+	CaName      string
+	AccountMail string
+	NotBefore   string
+	NotAfter    string
+
+	// leaf certificate first, followed by the chain
+	CertificatePem string
+}
+
+type CertificateImportRequest struct {
+	Mail   string
+	Bundle string
+}
+
+type ImportResult struct {
+	Results []string
+}
+
+type DnsProvider struct {
+	Tenant     string
+	Name       string
+	Type       string
+	CreateTime string
+}
+
+type DnsProviderCreateRequest struct {
+	Name string
+	// e.g. godaddy
+	Type string
+	// credentials of the type, e.g. key, secret and optional endpoint of godaddy
+	Credentials map[string]string
+}
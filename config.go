@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/eggsampler/acme"
+)
+
+// Config is loaded from the json file given by -config
+type Config struct {
+	// ordered CA profiles, the first one is the default
+	CaProfiles []*CaProfile
+	// listening address answering http-01 challenges, usually ":80". Empty to disable.
+	Http01Address string
+	// listening address answering tls-alpn-01 challenges, usually ":443". Empty to disable.
+	TlsAlpn01Address string
+	// dns server of CAA lookups, "host:port". Empty for the system resolver.
+	CaaResolver string
+
+	// bootstrap bearer token granted the admin scope, used to create api tokens
+	AdminToken string
+	// base64 of a 32 byte AES key encrypting the credentials of dns providers, required by dns providers
+	DnsCredentialKey string
+
+	// serve the api over tls when configured
+	ApiTls *ApiTlsConfig
+
+	// policy of accounts without their own policy, nil for no restriction
+	DefaultPolicy *Policy
+	// policies by account mail, "<tenant>/<mail>" for accounts of tenants
+	AccountPolicies map[string]*Policy
+}
+
+type ApiTlsConfig struct {
+	CertFile string
+	KeyFile  string
+	// CA bundle verifying client certificates, empty to disable client authentication
+	ClientCaFile string
+	// reject connections without a client certificate and requests of certificates
+	// matching no principal, bearer tokens are not usable then
+	RequireClientCert bool
+	// principals of client certificates
+	ClientPrincipals []*ClientPrincipal
+}
+
+// ClientPrincipal grants scopes to verified client certificates matching
+// the subject common name or one of the dns, uri or email SANs
+type ClientPrincipal struct {
+	Name       string
+	Tenant     string
+	CommonName string
+	San        string
+	Scopes     []string
+}
+
+type CaProfile struct {
+	Name         string
+	DirectoryUrl string
+	// consecutive failures of a domain before falling back to the next CA
+	FailoverAfter int
+	// whether the CA accepts subject fields other than common name in csr
+	SubjectFields bool
+	// issuer domain names of the CA in CAA records, empty to skip CAA checking
+	CaaIdentities []string
+	// overrides of the default limits by name: certificates_per_domain,
+	// duplicate_certificate, failed_validation and new_orders
+	RateLimits map[string]*RateLimitConfig
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		CaProfiles: []*CaProfile{
+			{
+				//TODO production
+				Name:          "letsencrypt-staging",
+				DirectoryUrl:  acme.LetsEncryptStaging,
+				FailoverAfter: 3,
+				CaaIdentities: []string{"letsencrypt.org"},
+			},
+		},
+	}
+}
+
+// loadConfig reads the config file. A missing file keeps the default config,
+// the default profiles are used if the file configures none.
+func loadConfig(f string) (*Config, error) {
+	data, err := ioutil.ReadFile(f)
+	if os.IsNotExist(err) {
+		return defaultConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// decoding over the default config would merge the first profile into the default profile
+	c := &Config{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.CaProfiles) == 0 {
+		c.CaProfiles = defaultConfig().CaProfiles
+	}
+	names := make(map[string]bool)
+	for _, v := range c.CaProfiles {
+		if v == nil {
+			return nil, errors.New("empty ca profile")
+		}
+		if len(v.Name) == 0 || len(v.DirectoryUrl) == 0 {
+			return nil, errors.New("name and directory url of ca profile are required")
+		}
+		if names[v.Name] {
+			return nil, errors.New("duplicate ca profile: " + v.Name)
+		}
+		names[v.Name] = true
+		if v.FailoverAfter <= 0 {
+			v.FailoverAfter = 3
+		}
+		err = v.validateRateLimits()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.DnsCredentialKey) > 0 {
+		key, err := base64.StdEncoding.DecodeString(c.DnsCredentialKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("dns credential key must be the base64 of 32 bytes")
+		}
+	}
+	if c.DefaultPolicy != nil {
+		err = c.DefaultPolicy.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.ApiTls != nil {
+		if len(c.ApiTls.CertFile) == 0 || len(c.ApiTls.KeyFile) == 0 {
+			return nil, errors.New("cert file and key file of api tls are required")
+		}
+		for _, v := range c.ApiTls.ClientPrincipals {
+			if v == nil || len(v.Name) == 0 || (len(v.CommonName) == 0 && len(v.San) == 0) {
+				return nil, errors.New("name and common name or san of client principal are required")
+			}
+			if !validTenantName(v.Tenant) {
+				return nil, errors.New("illegal tenant of client principal: " + v.Tenant)
+			}
+			for _, scope := range v.Scopes {
+				if !apiScopes[scope] {
+					return nil, errors.New("unknown scope of client principal: " + scope)
+				}
+			}
+		}
+	}
+	for _, v := range c.AccountPolicies {
+		if v == nil {
+			return nil, errors.New("empty account policy")
+		}
+		err = v.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (this *Config) caProfile(name string) *CaProfile {
+	if len(name) == 0 {
+		return this.CaProfiles[0]
+	}
+	for _, v := range this.CaProfiles {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (this *Config) caaResolver() string {
+	if len(this.CaaResolver) > 0 {
+		return this.CaaResolver
+	}
+	return systemResolver()
+}
+
+func (this *Config) policy(mail string) *Policy {
+	if v, ok := this.AccountPolicies[mail]; ok {
+		return v
+	}
+	return this.DefaultPolicy
+}
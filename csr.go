@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+)
+
+// TLS Feature extension, RFC 7633
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// status_request, the must-staple feature
+const tlsFeatureStatusRequest = 5
+
+// common name is limited to 64 characters
+const maxCommonNameLength = 64
+
+// CsrOptions are the per domain options of generated csr
+type CsrOptions struct {
+	MustStaple     bool
+	OmitCommonName bool
+
+	// subject fields, only sent when the CA profile supports them
+	Organization       []string
+	OrganizationalUnit []string
+	Country            []string
+	Province           []string
+	Locality           []string
+}
+
+func CreateCertificateRequest(certKey crypto.Signer, domainName string, domainList []string, options CsrOptions, subjectFields bool) (csr *x509.CertificateRequest, err error) {
+	// signature algorithm is chosen by the key type
+	tpl := &x509.CertificateRequest{
+		PublicKey: certKey.Public(),
+	}
+
+	// ip addresses are not dns names
+	for _, v := range domainList {
+		if ip := net.ParseIP(v); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, v)
+		}
+	}
+
+	if !options.OmitCommonName && len(domainName) <= maxCommonNameLength && net.ParseIP(domainName) == nil {
+		tpl.Subject.CommonName = domainName
+	}
+	if subjectFields {
+		tpl.Subject.Organization = options.Organization
+		tpl.Subject.OrganizationalUnit = options.OrganizationalUnit
+		tpl.Subject.Country = options.Country
+		tpl.Subject.Province = options.Province
+		tpl.Subject.Locality = options.Locality
+	}
+
+	if options.MustStaple {
+		value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+		if err != nil {
+			return nil, err
+		}
+		tpl.ExtraExtensions = append(tpl.ExtraExtensions, pkix.Extension{
+			Id:    oidTLSFeature,
+			Value: value,
+		})
+	}
+
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, tpl, certKey)
+	if err != nil {
+		logline("creating certificate error:", err)
+		return nil, err
+	}
+	csr, err = x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		logline("parsing certificate error:", err)
+		return nil, err
+	}
+	return csr, nil
+}
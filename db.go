@@ -8,6 +8,9 @@ import (
 	"github.com/dgraph-io/badger"
 )
 
+var ErrAccountInUse = errors.New("account is referenced by domains")
+var ErrDomainExists = errors.New("domain exists")
+
 func QueryAllDomain() ([]*Domain, error) {
 	var queryData [][]byte
 	err := db.View(func(txn *badger.Txn) error {
@@ -41,10 +44,55 @@ func QueryAllDomain() ([]*Domain, error) {
 	return result, nil
 }
 
-func QueryAccountByMail(mail string) (*Account, error) {
+// QueryDomain returns the domain together with the key of its in-flight order
+func QueryDomain(domain string) (*Domain, error) {
+	var domainData []byte
+	var orderKeyData []byte
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(DomainTable(domain))
+		if err != nil {
+			return err
+		}
+		domainData, err = item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		item, err = txn.Get(OrderKeyTable(domain))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		orderKeyData, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	domainObj := new(Domain)
+	err = json.Unmarshal(domainData, domainObj)
+	if err != nil {
+		logline("json unmarshal error:", err)
+		return nil, err
+	}
+	domainObj.OrderPrivateKeyString = string(orderKeyData)
+	if len(orderKeyData) == 0 {
+		// saved before order keys were moved out of domain records, moved on the next update
+		legacy := struct {
+			OrderPrivateKeyString string
+		}{}
+		_ = json.Unmarshal(domainData, &legacy)
+		domainObj.OrderPrivateKeyString = legacy.OrderPrivateKeyString
+	}
+	return domainObj, nil
+}
+
+func QueryAccountByMail(tenant string, mail string) (*Account, error) {
 	var accountData []byte
 	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(AccountTable(mail))
+		item, err := txn.Get(AccountTable(tenantKey(tenant, mail)))
 		if err != nil {
 			return err
 		}
@@ -79,6 +127,129 @@ func QueryAccountByMail(mail string) (*Account, error) {
 	return acc, nil
 }
 
+func QueryAllAccount() ([]*Account, error) {
+	var result []*Account
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(AccountTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			acc := new(Account)
+			err := it.Item().Value(func(v []byte) error {
+				accData, err := base64.StdEncoding.DecodeString(string(v))
+				if err != nil {
+					return err
+				}
+				return json.Unmarshal(accData, acc)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, acc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func AccountExists(tenant string, mail string) (bool, error) {
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(AccountTable(tenantKey(tenant, mail)))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SaveAccount saves the account under the mail in the tenant of the account
+func SaveAccount(mail string, acc *Account) error {
+	data, _ := json.Marshal(acc)
+	accountData := base64.StdEncoding.EncodeToString(data)
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(AccountTable(tenantKey(acc.Tenant, mail)), []byte(accountData))
+	})
+	if err != nil {
+		logline("save account to db error:", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteAccount removes the account from local storage.
+// It is refused with ErrAccountInUse while any domain of the tenant still references the account.
+func DeleteAccount(tenant string, mail string) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(AccountTable(tenantKey(tenant, mail)))
+		if err != nil {
+			return err
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(DomainTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			domain := new(Domain)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, domain)
+			})
+			if err != nil {
+				return err
+			}
+			if domain.Tenant != tenant {
+				continue
+			}
+			if domain.AccountMail == mail {
+				logline("account", mail, "is referenced by domain:", domain.Domain)
+				return ErrAccountInUse
+			}
+			for _, v := range domain.AccountList {
+				if v == mail {
+					logline("account", mail, "is a fallback of domain:", domain.Domain)
+					return ErrAccountInUse
+				}
+			}
+		}
+
+		// cached authorizations of the account
+		var authKeys [][]byte
+		authPrefix := AuthorizationTable(tenantKey(tenant, mail), "")
+		for it.Seek(authPrefix); it.ValidForPrefix(authPrefix); it.Next() {
+			auth := new(Authorization)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, auth)
+			})
+			if err != nil {
+				return err
+			}
+			// the prefix also matches mails starting with the same characters
+			if auth.Tenant == tenant && auth.AccountMail == mail {
+				authKeys = append(authKeys, it.Item().KeyCopy(nil))
+			}
+		}
+		for _, v := range authKeys {
+			err := txn.Delete(v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.Delete(AccountTable(tenantKey(tenant, mail)))
+	})
+	if err != nil {
+		logline("delete account error:", err)
+		return err
+	}
+	return nil
+}
+
 func UpdateDomain(domain string, domainObj *Domain) error {
 	domainData, _ := json.Marshal(domainObj)
 	err := db.Update(func(txn *badger.Txn) error {
@@ -88,7 +259,7 @@ func UpdateDomain(domain string, domainObj *Domain) error {
 			return err
 		}
 		if item != nil {
-			return errors.New("domain exists")
+			return ErrDomainExists
 		}
 		return txn.Set(DomainTable(domain), domainData)
 	})
@@ -102,7 +273,177 @@ func UpdateDomain(domain string, domainObj *Domain) error {
 func UpdateDomainDirect(domain string, domainObj *Domain) error {
 	domainData, _ := json.Marshal(domainObj)
 	err := db.Update(func(txn *badger.Txn) error {
-		return txn.Set(DomainTable(domain), domainData)
+		err := txn.Set(DomainTable(domain), domainData)
+		if err != nil {
+			return err
+		}
+		return saveOrderKey(txn, domain, domainObj)
 	})
+	if err == nil {
+		challengeIndexes.update(domainObj)
+	}
 	return err
 }
+
+// saveOrderKey keeps the order key of the domain in the order key table.
+// The key is dropped together with the order, domains loaded without the key keep it.
+func saveOrderKey(txn *badger.Txn, domain string, domainObj *Domain) error {
+	if len(domainObj.OrderUrl) == 0 {
+		return txn.Delete(OrderKeyTable(domain))
+	}
+	if len(domainObj.OrderPrivateKeyString) == 0 {
+		return nil
+	}
+	return txn.Set(OrderKeyTable(domain), []byte(domainObj.OrderPrivateKeyString))
+}
+
+func SaveCertificate(domain string, cert *Certificate) error {
+	certData, _ := json.Marshal(cert)
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(CertificateTable(domain), certData)
+	})
+	if err != nil {
+		logline("save certificate to db error:", err)
+		return err
+	}
+	return nil
+}
+
+func QueryAllCertificate() ([]*Certificate, error) {
+	var result []*Certificate
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(CertificateTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			cert := new(Certificate)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, cert)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, cert)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func QueryCertificate(domain string) (*Certificate, error) {
+	var certData []byte
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(CertificateTable(domain))
+		if err != nil {
+			return err
+		}
+		certData, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cert := new(Certificate)
+	err = json.Unmarshal(certData, cert)
+	if err != nil {
+		logline("json unmarshal error:", err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ImportDomainCertificate creates the available domain together with its certificate
+func ImportDomainCertificate(domainObj *Domain, cert *Certificate) error {
+	domainData, _ := json.Marshal(domainObj)
+	certData, _ := json.Marshal(cert)
+	err := db.Update(func(txn *badger.Txn) error {
+		// check not exist
+		_, err := txn.Get(DomainTable(domainObj.key()))
+		if err == nil {
+			return errors.New("domain exists")
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		err = txn.Set(DomainTable(domainObj.key()), domainData)
+		if err != nil {
+			return err
+		}
+		return txn.Set(CertificateTable(domainObj.key()), certData)
+	})
+	if err != nil {
+		logline("import domain certificate error:", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteDomain deletes the domain of the tenant key with its certificate, ocsp response and order key
+func DeleteDomain(domain string) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete(CertificateTable(domain))
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(OcspTable(domain))
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(OrderKeyTable(domain))
+		if err != nil {
+			return err
+		}
+		return txn.Delete(DomainTable(domain))
+	})
+	if err == nil {
+		challengeIndexes.remove(domain)
+	}
+	return err
+}
+
+// SaveAuthorizations updates the cached authorization states, errors are only logged
+func SaveAuthorizations(auths []*Authorization) {
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, v := range auths {
+			authData, _ := json.Marshal(v)
+			err := txn.Set(AuthorizationTable(tenantKey(v.Tenant, v.AccountMail), v.Identifier), authData)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logline("save authorizations to db error:", err)
+	}
+}
+
+func QueryAuthorizationsByMail(tenant string, mail string) ([]*Authorization, error) {
+	var result []*Authorization
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := AuthorizationTable(tenantKey(tenant, mail), "")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			auth := new(Authorization)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, auth)
+			})
+			if err != nil {
+				return err
+			}
+			if auth.Tenant == tenant && auth.AccountMail == mail {
+				result = append(result, auth)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// openTestDb replaces the store by an empty one in a temporary directory for the test
+func openTestDb(t *testing.T) {
+	testDb, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = testDb
+	t.Cleanup(func() {
+		db = saved
+		_ = testDb.Close()
+	})
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/eggsampler/acme"
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	ErrDnsProviderInUse  = errors.New("dns provider is referenced by domains")
+	ErrDnsProviderExists = errors.New("dns provider exists")
+)
+
+// DnsProvider is the credential of a dns api owned by a tenant.
+// Domains of the tenant with dns challenge publish their TXT records with it.
+type DnsProvider struct {
+	Tenant string
+	Name   string
+	// see dnsProviderTypes
+	Type string
+	// credentials encrypted by the DnsCredentialKey of the config, never returned by the api
+	SealedCredentials string `json:",omitempty"`
+	CreateTime        string
+}
+
+// dnsPublisher manages the TXT records of dns challenges
+type dnsPublisher interface {
+	// SetTxt replaces the TXT records of a name by the values
+	SetTxt(ctx context.Context, fqdn string, values []string) error
+	// DeleteTxt removes the TXT records of a name, missing records are no error
+	DeleteTxt(ctx context.Context, fqdn string) error
+}
+
+var dnsProviderTypes = map[string]func(credentials map[string]string) (dnsPublisher, error){
+	"godaddy": newGodaddyPublisher,
+}
+
+// newDnsProvider validates the credentials by their publisher and seals them
+func newDnsProvider(tenant string, name string, providerType string, credentials map[string]string) (*DnsProvider, error) {
+	// names are keyed within the tenant
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "name of dns provider is illegal: "+name)
+	}
+	newPublisher, ok := dnsProviderTypes[providerType]
+	if !ok {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "unknown dns provider type: "+providerType)
+	}
+	_, err := newPublisher(credentials)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+	}
+
+	provider := &DnsProvider{
+		Tenant:     tenant,
+		Name:       name,
+		Type:       providerType,
+		CreateTime: time.Now().Format(time.RFC3339Nano),
+	}
+	err = provider.sealCredentials(credentials)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// credentialCipher returns the AES-GCM cipher of the DnsCredentialKey
+func credentialCipher() (cipher.AEAD, error) {
+	if len(config.DnsCredentialKey) == 0 {
+		return nil, errors.New("no DnsCredentialKey configured, dns providers are not usable")
+	}
+	key, err := base64.StdEncoding.DecodeString(config.DnsCredentialKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealCredentials encrypts the credentials bound to the tenant and name of the provider,
+// so that sealed credentials can not be moved to other providers
+func (this *DnsProvider) sealCredentials(credentials map[string]string) error {
+	aead, err := credentialCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(credentials)
+	sealed := aead.Seal(nonce, nonce, data, []byte(tenantKey(this.Tenant, this.Name)))
+	this.SealedCredentials = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+func (this *DnsProvider) credentials() (map[string]string, error) {
+	aead, err := credentialCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(this.SealedCredentials)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed credentials are truncated: " + this.Name)
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(tenantKey(this.Tenant, this.Name)))
+	if err != nil {
+		return nil, errors.New("open credentials of dns provider " + this.Name + " error: " + err.Error())
+	}
+	credentials := make(map[string]string)
+	err = json.Unmarshal(data, &credentials)
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (this *DnsProvider) publisher() (dnsPublisher, error) {
+	newPublisher, ok := dnsProviderTypes[this.Type]
+	if !ok {
+		return nil, errors.New("unknown dns provider type: " + this.Type)
+	}
+	credentials, err := this.credentials()
+	if err != nil {
+		return nil, err
+	}
+	return newPublisher(credentials)
+}
+
+// dnsProviderView hides the credentials of the provider
+func dnsProviderView(provider *DnsProvider) *DnsProvider {
+	view := *provider
+	view.SealedCredentials = ""
+	return &view
+}
+
+// domainDnsPublisher returns the publisher of the dns provider of the domain, nil for records managed by hand
+func domainDnsPublisher(domain *Domain) (dnsPublisher, error) {
+	if len(domain.DnsProvider) == 0 {
+		return nil, nil
+	}
+	provider, err := QueryDnsProvider(domain.Tenant, domain.DnsProvider)
+	if err != nil {
+		logline("query dns provider error:", domain.DnsProvider, err)
+		return nil, err
+	}
+	return provider.publisher()
+}
+
+// dnsChallengeRecords returns the TXT record names of the dns-01 challenges of the domain with their values.
+// A wildcard and its base name share the record.
+func dnsChallengeRecords(domain *Domain) ([]string, map[string][]string, error) {
+	chals, err := domain.challenges()
+	if err != nil {
+		return nil, nil, err
+	}
+	var recordNames []string
+	records := make(map[string][]string)
+	for _, chal := range chals {
+		if chal.Type != acme.ChallengeTypeDNS01 || len(chal.Identifier) == 0 {
+			continue
+		}
+		recordName := "_acme-challenge." + strings.TrimPrefix(chal.Identifier, "*.")
+		if _, ok := records[recordName]; !ok {
+			recordNames = append(recordNames, recordName)
+		}
+		records[recordName] = append(records[recordName], acme.EncodeDNS01KeyAuthorization(chal.KeyAuthorization))
+	}
+	return recordNames, records, nil
+}
+
+// publishDnsChallenges publishes the dns-01 records of the domain with the dns provider of its tenant.
+// Domains without provider keep their records managed by hand.
+func publishDnsChallenges(ctx context.Context, domain *Domain) error {
+	publisher, err := domainDnsPublisher(domain)
+	if err != nil || publisher == nil {
+		return err
+	}
+	recordNames, records, err := dnsChallengeRecords(domain)
+	if err != nil {
+		return err
+	}
+	for _, v := range recordNames {
+		err := publisher.SetTxt(ctx, v, records[v])
+		if err != nil {
+			logline("publish dns record error:", v, err)
+			return err
+		}
+		logline("published dns record:", v, "by provider:", domain.DnsProvider)
+	}
+	return nil
+}
+
+// cleanupDnsChallenges removes the published dns-01 records of the domain once validation
+// has finished or failed, errors are only logged
+func cleanupDnsChallenges(ctx context.Context, domain *Domain) {
+	publisher, err := domainDnsPublisher(domain)
+	if err != nil {
+		logline("cleanup dns records error:", domain.Domain, err)
+		return
+	}
+	if publisher == nil {
+		return
+	}
+	recordNames, _, err := dnsChallengeRecords(domain)
+	if err != nil {
+		logline("cleanup dns records error:", domain.Domain, err)
+		return
+	}
+	for _, v := range recordNames {
+		err := publisher.DeleteTxt(ctx, v)
+		if err != nil {
+			logline("delete dns record error:", v, err)
+			continue
+		}
+		logline("deleted dns record:", v, "by provider:", domain.DnsProvider)
+	}
+}
+
+// godaddyPublisher uses the domains api of godaddy, credentials: key, secret and optional endpoint
+type godaddyPublisher struct {
+	endpoint string
+	key      string
+	secret   string
+	client   *http.Client
+}
+
+func newGodaddyPublisher(credentials map[string]string) (dnsPublisher, error) {
+	if len(credentials["key"]) == 0 || len(credentials["secret"]) == 0 {
+		return nil, errors.New("key and secret of godaddy are required")
+	}
+	endpoint := credentials["endpoint"]
+	if len(endpoint) == 0 {
+		endpoint = "https://api.godaddy.com"
+	}
+	return &godaddyPublisher{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		key:      credentials["key"],
+		secret:   credentials["secret"],
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (this *godaddyPublisher) SetTxt(ctx context.Context, fqdn string, values []string) error {
+	type record struct {
+		Data string `json:"data"`
+		Ttl  int    `json:"ttl"`
+	}
+	var body []record
+	for _, v := range values {
+		// 600 is the minimum ttl of godaddy
+		body = append(body, record{Data: v, Ttl: 600})
+	}
+	data, _ := json.Marshal(body)
+	_, err := this.do(ctx, http.MethodPut, fqdn, data)
+	return err
+}
+
+func (this *godaddyPublisher) DeleteTxt(ctx context.Context, fqdn string) error {
+	status, err := this.do(ctx, http.MethodDelete, fqdn, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// do sends a request to the TXT records of the name, the status of failed responses is returned with the error
+func (this *godaddyPublisher) do(ctx context.Context, method string, fqdn string, data []byte) (int, error) {
+	zone, err := publicsuffix.EffectiveTLDPlusOne(fqdn)
+	if err != nil {
+		return 0, err
+	}
+	recordName := strings.TrimSuffix(fqdn, "."+zone)
+
+	req, err := http.NewRequest(method, this.endpoint+"/v1/domains/"+zone+"/records/TXT/"+recordName, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "sso-key "+this.key+":"+this.secret)
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respData, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("godaddy responds %d: %s", resp.StatusCode, string(respData))
+	}
+	return resp.StatusCode, nil
+}
+
+func httpCreateDnsProvider(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	namePtr := param("name", q)
+	typePtr := param("type", q)
+	if namePtr == nil || len(*namePtr) == 0 || typePtr == nil || len(*typePtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	// credentials are sent in the body in order to keep them out of access logs
+	credentials := make(map[string]string)
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&credentials)
+	if err != nil {
+		logline("read credentials error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	provider, err := newDnsProvider(requestTenant(r), *namePtr, *typePtr, credentials)
+	if err != nil {
+		logline("dns provider is illegal:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	err = SaveDnsProvider(provider)
+	if err == ErrDnsProviderExists {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("dns provider exists."))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("submit."))
+}
+
+func httpListDnsProvider(w http.ResponseWriter, r *http.Request) {
+	result, err := QueryAllDnsProviders()
+	if err != nil {
+		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	var filtered []*DnsProvider
+	for _, v := range result {
+		if v.Tenant == requestTenant(r) {
+			filtered = append(filtered, dnsProviderView(v))
+		}
+	}
+
+	data, _ := json.Marshal(filtered)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func httpDeleteDnsProvider(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	namePtr := param("name", q)
+	if namePtr == nil || len(*namePtr) == 0 || strings.Contains(*namePtr, "/") {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	err := DeleteDnsProvider(requestTenant(r), *namePtr)
+	if err != nil {
+		if err == ErrDnsProviderInUse {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("submit."))
+}
+
+// SaveDnsProvider saves a new dns provider, existing providers are never overwritten
+// since domains of the tenant publish their records with them
+func SaveDnsProvider(provider *DnsProvider) error {
+	data, _ := json.Marshal(provider)
+	err := db.Update(func(txn *badger.Txn) error {
+		key := DnsProviderTable(tenantKey(provider.Tenant, provider.Name))
+		_, err := txn.Get(key)
+		if err == nil {
+			return ErrDnsProviderExists
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(key, data)
+	})
+	if err != nil {
+		logline("save dns provider to db error:", err)
+		return err
+	}
+	return nil
+}
+
+// QueryDnsProvider returns the dns provider of the name within the tenant
+func QueryDnsProvider(tenant string, name string) (*DnsProvider, error) {
+	provider := new(DnsProvider)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(DnsProviderTable(tenantKey(tenant, name)))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, provider)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func QueryAllDnsProviders() ([]*DnsProvider, error) {
+	var result []*DnsProvider
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(DnsProviderTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			provider := new(DnsProvider)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, provider)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, provider)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteDnsProvider deletes the dns provider of the tenant.
+// It is refused with ErrDnsProviderInUse while any domain of the tenant still references the provider.
+func DeleteDnsProvider(tenant string, name string) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(DnsProviderTable(tenantKey(tenant, name)))
+		if err != nil {
+			return err
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(DomainTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			domain := new(Domain)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, domain)
+			})
+			if err != nil {
+				return err
+			}
+			if domain.Tenant == tenant && domain.DnsProvider == name {
+				logline("dns provider", name, "is referenced by domain:", domain.Domain)
+				return ErrDnsProviderInUse
+			}
+		}
+		return txn.Delete(DnsProviderTable(tenantKey(tenant, name)))
+	})
+	if err != nil {
+		logline("delete dns provider error:", err)
+		return err
+	}
+	return nil
+}
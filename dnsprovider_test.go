@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eggsampler/acme"
+)
+
+var testDnsCredentialKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// godaddyRequest is a request received by the fake godaddy api
+type godaddyRequest struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   string
+}
+
+func fakeGodaddy(t *testing.T) (*httptest.Server, func() []godaddyRequest) {
+	var lock sync.Mutex
+	var requests []godaddyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, godaddyRequest{r.Method, r.URL.Path, r.Header.Get("Authorization"), string(body)})
+		lock.Unlock()
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/_acme-challenge.gone") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []godaddyRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]godaddyRequest(nil), requests...)
+	}
+}
+
+func TestDnsProviderCredentials(t *testing.T) {
+	useTestConfig(t, &Config{DnsCredentialKey: testDnsCredentialKey})
+	credentials := map[string]string{"key": "api-key", "secret": "api-secret"}
+
+	provider, err := newDnsProvider("team-a", "godaddy-main", "godaddy", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(provider.SealedCredentials, "api-secret") {
+		t.Error("credentials are stored in plain text")
+	}
+	data, _ := json.Marshal(dnsProviderView(provider))
+	if strings.Contains(string(data), provider.SealedCredentials) {
+		t.Error("view of dns provider contains credentials")
+	}
+	opened, err := provider.credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened, credentials) {
+		t.Errorf("opened credentials %v", opened)
+	}
+
+	// sealed credentials are bound to the provider
+	moved := *provider
+	moved.Tenant = "team-b"
+	if _, err := moved.credentials(); err == nil {
+		t.Error("credentials opened by provider of other tenant")
+	}
+
+	config.DnsCredentialKey = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	if _, err := provider.credentials(); err == nil {
+		t.Error("credentials opened by other key")
+	}
+	config.DnsCredentialKey = ""
+	if _, err := newDnsProvider("", "godaddy-main", "godaddy", credentials); err == nil {
+		t.Error("dns provider created without credential key")
+	}
+}
+
+func TestNewDnsProviderInvalid(t *testing.T) {
+	useTestConfig(t, &Config{DnsCredentialKey: testDnsCredentialKey})
+	credentials := map[string]string{"key": "api-key", "secret": "api-secret"}
+
+	invalid := map[string]func() (*DnsProvider, error){
+		"empty name":      func() (*DnsProvider, error) { return newDnsProvider("", "", "godaddy", credentials) },
+		"name with slash": func() (*DnsProvider, error) { return newDnsProvider("", "team-a/main", "godaddy", credentials) },
+		"unknown type":    func() (*DnsProvider, error) { return newDnsProvider("", "main", "route53", credentials) },
+		"missing secret": func() (*DnsProvider, error) {
+			return newDnsProvider("", "main", "godaddy", map[string]string{"key": "api-key"})
+		},
+	}
+	for name, create := range invalid {
+		_, err := create()
+		if apiErr, ok := err.(*ApiError); !ok || apiErr.Status != http.StatusBadRequest {
+			t.Errorf("%s: error %v, want bad request", name, err)
+		}
+	}
+}
+
+func TestSaveDnsProvider(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{DnsCredentialKey: testDnsCredentialKey})
+
+	first, _ := newDnsProvider("", "main", "godaddy", map[string]string{"key": "first", "secret": "first"})
+	second, _ := newDnsProvider("", "main", "godaddy", map[string]string{"key": "second", "secret": "second"})
+	other, _ := newDnsProvider("team-a", "main", "godaddy", map[string]string{"key": "other", "secret": "other"})
+	if err := SaveDnsProvider(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveDnsProvider(second); err != ErrDnsProviderExists {
+		t.Errorf("overwrite of dns provider: error %v", err)
+	}
+	if err := SaveDnsProvider(other); err != nil {
+		t.Error("same name of other tenant:", err)
+	}
+	saved, err := QueryDnsProvider("", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, _ := saved.credentials()
+	if credentials["key"] != "first" {
+		t.Errorf("saved credentials %v", credentials)
+	}
+
+	domain := &Domain{Domain: "example.com", DnsProvider: "main"}
+	if err := UpdateDomainDirect(domain.key(), domain); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteDnsProvider("", "main"); err != ErrDnsProviderInUse {
+		t.Errorf("delete of used dns provider: error %v", err)
+	}
+	if err := DeleteDnsProvider("team-a", "main"); err != nil {
+		t.Error("delete of dns provider used by other tenant:", err)
+	}
+}
+
+func TestPublishAndCleanupDnsChallenges(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{DnsCredentialKey: testDnsCredentialKey})
+	server, requests := fakeGodaddy(t)
+
+	provider, err := newDnsProvider("team-a", "main", "godaddy", map[string]string{"key": "k", "secret": "s", "endpoint": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveDnsProvider(provider); err != nil {
+		t.Fatal(err)
+	}
+	chals, _ := json.Marshal([]Challenge{
+		{Type: acme.ChallengeTypeDNS01, Identifier: "example.com", KeyAuthorization: "auth-1"},
+		{Type: acme.ChallengeTypeDNS01, Identifier: "*.example.com", KeyAuthorization: "auth-2"},
+		{Type: acme.ChallengeTypeDNS01, Identifier: "www.example.org", KeyAuthorization: "auth-3"},
+		{Type: acme.ChallengeTypeHTTP01, Identifier: "www.example.com", Token: "token"},
+	})
+	domain := &Domain{Tenant: "team-a", Domain: "example.com", DnsProvider: "main", ChallengeData: string(chals)}
+
+	recordNames, records, err := dnsChallengeRecords(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"_acme-challenge.example.com", "_acme-challenge.www.example.org"}; !reflect.DeepEqual(recordNames, want) {
+		t.Fatalf("record names %v, want %v", recordNames, want)
+	}
+	if len(records["_acme-challenge.example.com"]) != 2 {
+		t.Errorf("wildcard and base name do not share the record: %v", records)
+	}
+
+	if err := publishDnsChallenges(context.Background(), domain); err != nil {
+		t.Fatal(err)
+	}
+	cleanupDnsChallenges(context.Background(), domain)
+	got := requests()
+	want := []godaddyRequest{
+		{http.MethodPut, "/v1/domains/example.com/records/TXT/_acme-challenge", "sso-key k:s", ""},
+		{http.MethodPut, "/v1/domains/example.org/records/TXT/_acme-challenge.www", "sso-key k:s", ""},
+		{http.MethodDelete, "/v1/domains/example.com/records/TXT/_acme-challenge", "sso-key k:s", ""},
+		{http.MethodDelete, "/v1/domains/example.org/records/TXT/_acme-challenge.www", "sso-key k:s", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("requests %+v", got)
+	}
+	for i, v := range got {
+		body := v.Body
+		v.Body = ""
+		if v != want[i] {
+			t.Errorf("request %d: %+v, want %+v", i, v, want[i])
+		}
+		if i == 0 && (!strings.Contains(body, acme.EncodeDNS01KeyAuthorization("auth-1")) || !strings.Contains(body, acme.EncodeDNS01KeyAuthorization("auth-2"))) {
+			t.Errorf("records of the shared name: %s", body)
+		}
+	}
+
+	// domains without provider manage their records by hand
+	domain.DnsProvider = ""
+	if err := publishDnsChallenges(context.Background(), domain); err != nil {
+		t.Error(err)
+	}
+	cleanupDnsChallenges(context.Background(), domain)
+	if len(requests()) != len(want) {
+		t.Error("records of domain without provider are published")
+	}
+}
+
+func TestGodaddyDeleteMissingRecord(t *testing.T) {
+	server, _ := fakeGodaddy(t)
+	publisher, err := newGodaddyPublisher(map[string]string{"key": "k", "secret": "s", "endpoint": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.DeleteTxt(context.Background(), "_acme-challenge.gone.example.com"); err != nil {
+		t.Error("delete of missing record:", err)
+	}
+}
+
+func TestLoadConfigDnsCredentialKey(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "config.json")
+	keys := map[string]bool{
+		testDnsCredentialKey: true,
+		base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")): false,
+		"not base64": false,
+	}
+	for key, valid := range keys {
+		_ = ioutil.WriteFile(f, []byte(`{"DnsCredentialKey": "`+key+`"}`), 0600)
+		_, err := loadConfig(f)
+		if (err == nil) != valid {
+			t.Errorf("load of key %q: error %v", key, err)
+		}
+	}
+}
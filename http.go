@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -12,6 +18,13 @@ import (
 
 var AccountTablePrefix = "account_"
 var DomainTablePrefix = "domain_"
+var CertificateTablePrefix = "certificate_"
+var AuthorizationTablePrefix = "authorization_"
+var RateLimitTablePrefix = "ratelimit_"
+var OcspTablePrefix = "ocsp_"
+var TokenTablePrefix = "token_"
+var OrderKeyTablePrefix = "orderkey_"
+var DnsProviderTablePrefix = "dnsprovider_"
 
 /*
  * //TODO
@@ -20,12 +33,21 @@ var DomainTablePrefix = "domain_"
  * challenging -> pending (when token expire/error)
  * challenging -> available (when cert generated)
  * available -> pending (when cert nearly/already expired)
+ * pending/challenging -> failed (when max attempts reached)
+ * failed -> pending (manual retry)
+ * imported certificates start as available
  */
 var (
 	IssuePending     = "pending"
 	IssueChallenging = "challenging"
 
 	IssueAvailable = "available"
+	IssueFailed    = "failed"
+)
+
+var (
+	AccountValid       = "valid"
+	AccountDeactivated = "deactivated"
 )
 
 func AccountTable(primaryKey string) []byte {
@@ -36,21 +58,121 @@ func DomainTable(primaryKey string) []byte {
 	return []byte(DomainTablePrefix + primaryKey)
 }
 
-func startHttp(laddr string) {
+func CertificateTable(primaryKey string) []byte {
+	return []byte(CertificateTablePrefix + primaryKey)
+}
+
+func newHttpServer(laddr string) (*http.Server, error) {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/register", httpRegisterAccount)
-	mux.HandleFunc("/list_account", httpListAccount)
+	mux.HandleFunc("/register", requireScope(ScopeAccountsWrite, httpRegisterAccount))
+	mux.HandleFunc("/list_account", requireScope(ScopeAccountsRead, httpListAccount))
+	mux.HandleFunc("/import_account", requireScope(ScopeAccountsWrite, httpImportAccount))
+	mux.HandleFunc("/update_account", requireScope(ScopeAccountsWrite, httpUpdateAccount))
+	mux.HandleFunc("/deactivate_account", requireScope(ScopeAccountsWrite, httpDeactivateAccount))
+	mux.HandleFunc("/delete_account", requireScope(ScopeAccountsWrite, httpDeleteAccount))
+	mux.HandleFunc("/list_authorization", requireScope(ScopeAccountsRead, httpListAuthorization))
 
-	mux.HandleFunc("/new_issue", httpNewIssue)
-	mux.HandleFunc("/list_issue", httpListAllIssue)
+	mux.HandleFunc("/new_issue", requireScope(ScopeIssuesWrite, httpNewIssue))
+	mux.HandleFunc("/new_issue_csr", requireScope(ScopeIssuesWrite, httpNewIssueCsr))
+	mux.HandleFunc("/update_key_policy", requireScope(ScopeIssuesWrite, httpUpdateKeyPolicy))
+	mux.HandleFunc("/list_issue", requireScope(ScopeIssuesRead, httpListAllIssue))
+	mux.HandleFunc("/import_certificate", requireScope(ScopeIssuesWrite, httpImportCertificate))
+	mux.HandleFunc("/list_rate_limit", requireScope(ScopeIssuesRead, httpListRateLimit))
+	mux.HandleFunc("/list_ocsp", requireScope(ScopeIssuesRead, httpListOcsp))
 
 	// internal
-	mux.HandleFunc("/trigger_job", httpTriggerJob)
-	mux.HandleFunc("/delete_issue", httpDeleteIssue)
+	mux.HandleFunc("/trigger_job", requireScope(ScopeAdmin, httpTriggerJob))
+	mux.HandleFunc("/delete_issue", requireScope(ScopeAdmin, httpDeleteIssue))
+	mux.HandleFunc("/retry_issue", requireScope(ScopeAdmin, httpRetryIssue))
+
+	mux.HandleFunc(ApiV2Prefix, httpApiV2)
+	mux.HandleFunc(ApiV2Prefix+"openapi.json", httpOpenApi)
+
+	// api tokens
+	mux.HandleFunc("/create_token", requireScope(ScopeAdmin, httpCreateToken))
+	mux.HandleFunc("/list_token", requireScope(ScopeAdmin, httpListToken))
+	mux.HandleFunc("/revoke_token", requireScope(ScopeAdmin, httpRevokeToken))
+
+	// dns provider credentials of the tenant
+	mux.HandleFunc("/create_dns_provider", requireScope(ScopeAdmin, httpCreateDnsProvider))
+	mux.HandleFunc("/list_dns_provider", requireScope(ScopeAdmin, httpListDnsProvider))
+	mux.HandleFunc("/delete_dns_provider", requireScope(ScopeAdmin, httpDeleteDnsProvider))
 
-	err := http.ListenAndServe(laddr, mux)
+	tlsConfig, err := apiTlsConfig()
 	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:      laddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}, nil
+}
+
+// apiTlsConfig loads the server certificate and client CA bundle, nil for plain http
+func apiTlsConfig() (*tls.Config, error) {
+	if config.ApiTls == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.ApiTls.CertFile, config.ApiTls.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(config.ApiTls.ClientCaFile) > 0 {
+		caData, err := ioutil.ReadFile(config.ApiTls.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificate in client ca file: " + config.ApiTls.ClientCaFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.ApiTls.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+func AuthorizationTable(mail string, identifier string) []byte {
+	return []byte(AuthorizationTablePrefix + mail + "_" + identifier)
+}
+
+func RateLimitTable(limit string, key string) []byte {
+	return []byte(RateLimitTablePrefix + limit + "_" + key)
+}
+
+func OcspTable(domain string) []byte {
+	return []byte(OcspTablePrefix + domain)
+}
+
+func TokenTable(id string) []byte {
+	return []byte(TokenTablePrefix + id)
+}
+
+func OrderKeyTable(domain string) []byte {
+	return []byte(OrderKeyTablePrefix + domain)
+}
+
+func DnsProviderTable(primaryKey string) []byte {
+	return []byte(DnsProviderTablePrefix + primaryKey)
+}
+
+func startHttp(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
@@ -65,7 +187,7 @@ func param(key string, q url.Values) *string {
 }
 
 func httpTriggerJob(w http.ResponseWriter, r *http.Request) {
-	startJobProcessing()
+	scheduler.Notify()
 
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("ok."))
@@ -75,9 +197,29 @@ func httpTriggerJob(w http.ResponseWriter, r *http.Request) {
 func httpDeleteIssue(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	domainPtr := param("domain", q)
-	err := db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(DomainTable(*domainPtr))
-	})
+	if domainPtr == nil || len(*domainPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	domainKey := tenantKey(requestTenant(r), *domainPtr)
+	if !domainLocks.tryLock(domainKey) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("domain is being processed."))
+		return
+	}
+	defer domainLocks.unlock(domainKey)
+
+	_, err := tenantDomain(r, *domainPtr)
+	if err != nil {
+		logline("query domain error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	err = DeleteDomain(domainKey)
 	if err != nil {
 		logline("delete domain error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -89,8 +231,145 @@ func httpDeleteIssue(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("submit."))
 }
 
+func keyPolicyParams(q url.Values) (reuseKey bool, keyRotationDays int, err error) {
+	if v := param("reuse_key", q); v != nil && len(*v) > 0 {
+		reuseKey, err = strconv.ParseBool(*v)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	if v := param("key_rotation_days", q); v != nil && len(*v) > 0 {
+		keyRotationDays, err = strconv.Atoi(*v)
+		if err != nil {
+			return false, 0, err
+		}
+		if keyRotationDays < 0 {
+			return false, 0, errors.New("key rotation days is negative")
+		}
+	}
+	return reuseKey, keyRotationDays, nil
+}
+
+func csrOptionsParams(q url.Values) (CsrOptions, error) {
+	options := CsrOptions{
+		Organization:       q["org"],
+		OrganizationalUnit: q["org_unit"],
+		Country:            q["country"],
+		Province:           q["province"],
+		Locality:           q["locality"],
+	}
+	if v := param("must_staple", q); v != nil && len(*v) > 0 {
+		mustStaple, err := strconv.ParseBool(*v)
+		if err != nil {
+			return options, err
+		}
+		options.MustStaple = mustStaple
+	}
+	if v := param("omit_cn", q); v != nil && len(*v) > 0 {
+		omitCommonName, err := strconv.ParseBool(*v)
+		if err != nil {
+			return options, err
+		}
+		options.OmitCommonName = omitCommonName
+	}
+	return options, nil
+}
+
+func httpUpdateKeyPolicy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	domainPtr := param("domain", q)
+	if domainPtr == nil || len(*domainPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	reuseKey, keyRotationDays, err := keyPolicyParams(q)
+	if err != nil {
+		logline("key policy is illegal:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	domainKey := tenantKey(requestTenant(r), *domainPtr)
+	if !domainLocks.tryLock(domainKey) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("domain is being processed."))
+		return
+	}
+	defer domainLocks.unlock(domainKey)
+
+	domain, err := tenantDomain(r, *domainPtr)
+	if err != nil {
+		logline("query domain error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	domain.ReuseKey = reuseKey
+	domain.KeyRotationDays = keyRotationDays
+	err = UpdateDomainDirect(domain.key(), domain)
+	if err != nil {
+		logline("update domain error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	scheduler.Notify()
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok."))
+}
+
+func httpRetryIssue(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	domainPtr := param("domain", q)
+	if domainPtr == nil || len(*domainPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	domainKey := tenantKey(requestTenant(r), *domainPtr)
+	if !domainLocks.tryLock(domainKey) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("domain is being processed."))
+		return
+	}
+	defer domainLocks.unlock(domainKey)
+
+	domain, err := tenantDomain(r, *domainPtr)
+	if err != nil {
+		logline("query domain error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	if domain.Status != IssueFailed {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("domain is not failed."))
+		return
+	}
+
+	domain.Status = IssuePending
+	resetAttempts(domain)
+	err = UpdateDomainDirect(domain.key(), domain)
+	if err != nil {
+		logline("update domain error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	scheduler.Notify()
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("submit."))
+}
+
 func httpListAllIssue(w http.ResponseWriter, r *http.Request) {
-	result, err := QueryAllDomain()
+	domains, err := QueryAllDomain()
 
 	if err != nil {
 		logline("query error:", err)
@@ -98,6 +377,12 @@ func httpListAllIssue(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
+	var result []*Domain
+	for _, v := range domains {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, v)
+		}
+	}
 
 	data, _ := json.Marshal(result)
 	w.WriteHeader(http.StatusOK)
@@ -106,87 +391,338 @@ func httpListAllIssue(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpNewIssue(w http.ResponseWriter, r *http.Request) {
+	newIssue(w, r, "")
+}
+
+// httpNewIssueCsr issues a certificate for the PEM CSR in the request body.
+// The private key stays with the requester, only the certificate is stored.
+func httpNewIssueCsr(w http.ResponseWriter, r *http.Request) {
+	csrData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil || len(csrData) == 0 {
+		logline("read csr data error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	newIssue(w, r, string(csrData))
+}
+
+func newIssue(w http.ResponseWriter, r *http.Request, csrPem string) {
 	q := r.URL.Query()
 
 	mailPtr := param("mail", q)
 	challengePtr := param("challenge", q)
 	domainPtr := param("domain", q)
 
-	if mailPtr == nil || challengePtr == nil || len(*mailPtr) == 0 || len(*challengePtr) == 0 || len(*domainPtr) == 0 || len(*domainPtr) == 0 {
+	if mailPtr == nil || challengePtr == nil || len(*mailPtr) == 0 || len(*challengePtr) == 0 || domainPtr == nil || len(*domainPtr) == 0 {
 		logline("one of params is empty.")
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
 
-	switch *challengePtr {
-	case "dns":
-	default:
-		logline("challenge is illegal.")
+	reuseKey, keyRotationDays, err := keyPolicyParams(q)
+	if err != nil {
+		logline("key policy is illegal:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
 
-	var accountData []byte
-	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(AccountTable(*mailPtr))
+	csrOptions, err := csrOptionsParams(q)
+	if err != nil {
+		logline("csr options are illegal:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	_, err = createIssue(r, &IssueRequest{
+		Domain:          *domainPtr,
+		AltNames:        q["alt"],
+		Mail:            *mailPtr,
+		Fallback:        q["fallback"],
+		Challenge:       *challengePtr,
+		DnsProvider:     q.Get("dns_provider"),
+		Csr:             csrPem,
+		CsrOptions:      csrOptions,
+		ReuseKey:        reuseKey,
+		KeyRotationDays: keyRotationDays,
+	})
+	if err != nil {
+		logline("new issue error:", err)
+		if apiErr, ok := err.(*ApiError); ok && apiErr.Status == http.StatusForbidden {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("submit."))
+}
+
+// IssueRequest is a certificate request of the api
+type IssueRequest struct {
+	Domain    string
+	AltNames  []string
+	Mail      string
+	Fallback  []string
+	Challenge string
+	// dns provider of the tenant publishing the records of dns challenges, empty for records managed by hand
+	DnsProvider string
+	// PEM CSR, the private key stays with the requester
+	Csr        string
+	CsrOptions CsrOptions
+
+	ReuseKey        bool
+	KeyRotationDays int
+}
+
+// createIssue validates the request and creates the pending domain in the tenant of the caller
+func createIssue(r *http.Request, req *IssueRequest) (*Domain, error) {
+	if len(req.Mail) == 0 || len(req.Challenge) == 0 || len(req.Domain) == 0 {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "mail, challenge and domain are required")
+	}
+	if req.KeyRotationDays < 0 {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "key rotation days is negative")
+	}
+
+	names, err := validateIssueNames(append([]string{req.Domain}, req.AltNames...), req.Challenge)
+	if err != nil {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+	}
+	// http-01 and tls-alpn-01 validations are answered by the challenge listeners
+	if (req.Challenge == "http" && len(config.Http01Address) == 0) || (req.Challenge == "tls-alpn" && len(config.TlsAlpn01Address) == 0) {
+		return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "no listener of challenge configured: "+req.Challenge)
+	}
+	if len(req.DnsProvider) > 0 {
+		if req.Challenge != "dns" {
+			return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "dns provider is used by dns challenge only")
+		}
+		_, err := QueryDnsProvider(requestTenant(r), req.DnsProvider)
+		if err == badger.ErrKeyNotFound || strings.Contains(req.DnsProvider, "/") {
+			return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "dns provider not found: "+req.DnsProvider)
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = item.Value(func(val []byte) error {
-			accountData = val
-			return nil
-		})
+	}
+	if len(req.Csr) > 0 {
+		err := validateCsrNames(req.Csr, names)
 		if err != nil {
-			return err
+			return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "csr is illegal: "+err.Error())
 		}
-		return nil
-	})
+	}
+
+	// ordered accounts, the fallback accounts possibly at other CAs
+	accountList := append([]string{req.Mail}, req.Fallback...)
+	for _, v := range accountList {
+		acc, err := tenantAccount(r, v)
+		if err == badger.ErrKeyNotFound {
+			return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "account not found: "+v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if acc.Status == AccountDeactivated {
+			return nil, newApiError(http.StatusBadRequest, ErrorInvalidRequest, "account is deactivated: "+v)
+		}
+	}
+
+	err = checkPolicy(requestTenant(r), accountList, names)
+	if err != nil {
+		return nil, newApiError(http.StatusForbidden, ErrorForbidden, err.Error())
+	}
+
+	// create issue domain task
+	nowTime := time.Now().Format(time.RFC3339Nano)
+	domain := &Domain{
+		Tenant:        requestTenant(r),
+		Domain:        names[0],
+		AltNames:      names[1:],
+		AccountMail:   req.Mail,
+		AccountList:   accountList,
+		ChallengeType: req.Challenge,
+		DnsProvider:   req.DnsProvider,
+		Status:        IssuePending,
+		CsrPem:        req.Csr,
+
+		CsrOptions: req.CsrOptions,
+
+		ReuseKey:        req.ReuseKey,
+		KeyRotationDays: req.KeyRotationDays,
+
+		CreateTime: nowTime,
+	}
+
+	err = checkCaaAccounts(r.Context(), domain)
+	if _, ok := err.(*ProblemError); ok {
+		return nil, newApiError(http.StatusBadRequest, ErrorCaaForbidden, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = UpdateDomain(domain.key(), domain)
+	if err == ErrDomainExists {
+		return nil, newApiError(http.StatusConflict, ErrorConflict, "domain exists: "+domain.Domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	scheduler.Notify()
+	return domain, nil
+}
+
+// httpImportCertificate imports certificates issued elsewhere for renewal by the given account.
+// The request body contains PEM certificates and private keys, multiple pairs are allowed.
+func httpImportCertificate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mailPtr := param("mail", q)
+	if mailPtr == nil || len(*mailPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	acc, err := tenantAccount(r, *mailPtr)
 	if err != nil {
-		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	if acc.Status == AccountDeactivated {
+		logline("account is deactivated:", *mailPtr)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
 
-	accData, err := base64.StdEncoding.DecodeString(string(accountData))
+	bundleData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16*1024*1024))
 	if err != nil {
-		logline("base64 decode error:", err)
+		logline("read certificate data error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
-	acc := new(Account)
-	err = json.Unmarshal(accData, acc)
+	bundle, err := ParseCertificateBundle(bundleData)
 	if err != nil {
-		logline("json unmarshal error:", err)
+		logline("parse certificate bundle error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
 
-	// create issue domain task
-	nowTime := time.Now().Format(time.RFC3339Nano)
-	domain := &Domain{
-		Domain:        *domainPtr,
-		AccountMail:   *mailPtr,
-		ChallengeType: *challengePtr,
-		Status:        IssuePending,
+	result := importCertificates(r, *mailPtr, bundle)
 
-		CreateTime: nowTime,
+	data, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// importCertificates creates an available domain of the tenant of the caller for every certificate.
+// It returns the result of every certificate.
+func importCertificates(r *http.Request, mail string, bundle []*ImportedCertificate) []string {
+	var result []string
+	for _, v := range bundle {
+		domainName, altNames, err := certificateNames(v.Leaf)
+		if err != nil {
+			logline("import certificate error:", v.Leaf.Subject, err)
+			result = append(result, v.Leaf.Subject.CommonName+": "+err.Error())
+			continue
+		}
+		err = checkPolicy(requestTenant(r), []string{mail}, append([]string{domainName}, altNames...))
+		if err != nil {
+			logline("import certificate is not allowed:", domainName, err)
+			result = append(result, domainName+": "+err.Error())
+			continue
+		}
+		privKeyString, err := encodePrivateKey(v.PrivateKey)
+		if err != nil {
+			logline("encode private key error:", domainName, err)
+			result = append(result, domainName+": "+err.Error())
+			continue
+		}
+		certPem := encodeCertificatePem(append([]*x509.Certificate{v.Leaf}, v.Chain...))
+		cert, err := NewCertificateRecord(domainName, CertificateImported, []byte(certPem), privKeyString)
+		if err != nil {
+			logline("create certificate record error:", domainName, err)
+			result = append(result, domainName+": "+err.Error())
+			continue
+		}
+		cert.Tenant = requestTenant(r)
+
+		nowTime := time.Now().Format(time.RFC3339Nano)
+		domain := &Domain{
+			Tenant:        requestTenant(r),
+			Domain:        domainName,
+			AltNames:      altNames,
+			AccountMail:   mail,
+			AccountList:   []string{mail},
+			ChallengeType: "dns",
+			Status:        IssueAvailable,
+
+			CreateTime:    nowTime,
+			IssueTime:     cert.NotBefore,
+			ExpireTime:    cert.NotAfter,
+			KeyCreateTime: cert.NotBefore,
+		}
+		err = ImportDomainCertificate(domain, cert)
+		if err != nil {
+			result = append(result, domainName+": "+err.Error())
+			continue
+		}
+		err = writeCertificateFiles(domain, []byte(certPem), v.PrivateKey)
+		if err != nil {
+			result = append(result, domainName+": "+err.Error())
+			continue
+		}
+		result = append(result, domainName+": imported")
 	}
+	scheduler.Notify()
+	return result
+}
 
-	err = UpdateDomain(*domainPtr, domain)
+func httpListRateLimit(w http.ResponseWriter, r *http.Request) {
+	result, err := QueryAllRateLimits()
+	if err == nil && !isSystemAdmin(r) {
+		result, err = tenantRateLimits(requestTenant(r), result)
+	}
 	if err != nil {
-		logline("save domain issue job error:", err)
+		logline("query error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("error occurs."))
 		return
 	}
 
+	data, _ := json.Marshal(result)
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("submit."))
+	_, _ = w.Write(data)
+}
+
+func httpListOcsp(w http.ResponseWriter, r *http.Request) {
+	responses, err := QueryAllOcspResponses()
+	if err != nil {
+		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	var result []*OcspResponse
+	for _, v := range responses {
+		if v.Tenant == requestTenant(r) {
+			result = append(result, v)
+		}
+	}
+
+	data, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
 }
 
 func httpListAccount(w http.ResponseWriter, r *http.Request) {
@@ -215,8 +751,8 @@ func httpListAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := make([]*Account, len(queryData))
-	for i, v := range queryData {
+	result := make([]*Account, 0, len(queryData))
+	for _, v := range queryData {
 		b, err := base64.StdEncoding.DecodeString(string(v))
 		if err != nil {
 			logline("decode error:", err)
@@ -226,9 +762,12 @@ func httpListAccount(w http.ResponseWriter, r *http.Request) {
 		}
 		acc := new(Account)
 		_ = json.Unmarshal(b, acc)
+		if acc.Tenant != requestTenant(r) {
+			continue
+		}
 		// hide private key
 		acc.PrivateKeyString = ""
-		result[i] = acc
+		result = append(result, acc)
 	}
 
 	data, _ := json.Marshal(result)
@@ -237,6 +776,49 @@ func httpListAccount(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func httpListAuthorization(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mailPtr := param("mail", q)
+	if mailPtr == nil || len(*mailPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	_, err := tenantAccount(r, *mailPtr)
+	if err != nil {
+		logline("query account error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	result, err := QueryAuthorizationsByMail(requestTenant(r), *mailPtr)
+	if err != nil {
+		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	// filter by identifier if given
+	identifierPtr := param("identifier", q)
+	if identifierPtr != nil && len(*identifierPtr) > 0 {
+		var filtered []*Authorization
+		for _, v := range result {
+			if v.Identifier == *identifierPtr {
+				filtered = append(filtered, v)
+			}
+		}
+		result = filtered
+	}
+
+	data, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
 func httpRegisterAccount(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 
@@ -253,10 +835,29 @@ func httpRegisterAccount(w http.ResponseWriter, r *http.Request) {
 
 	name := *namePtr
 	mail := *mailPtr
+	// optional, the default CA profile if not given
+	caName := ""
+	if caPtr := param("ca", q); caPtr != nil {
+		caName = *caPtr
+	}
 
-	logline("incoming request...", "name:", name, "mail:", mail)
+	logline("incoming request...", "name:", name, "mail:", mail, "ca:", caName)
 
-	acc, err := client.Register([]string{mail})
+	if !validAccountMail(mail) {
+		logline("mail is illegal:", mail)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	client, err := caClient(caName)
+	if err != nil {
+		logline("get ca client error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	acc, err := client.Register(r.Context(), []string{mail})
 	if err != nil {
 		logline("register error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -264,11 +865,9 @@ func httpRegisterAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	acc.AccountName = name
-	data, _ := json.Marshal(acc)
-	accountData := base64.StdEncoding.EncodeToString(data)
-	err = db.Update(func(txn *badger.Txn) error {
-		return txn.Set(AccountTable(mail), []byte(accountData))
-	})
+	acc.CaName = config.caProfile(caName).Name
+	acc.Tenant = requestTenant(r)
+	err = SaveAccount(mail, acc)
 	if err != nil {
 		logline("save error:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -279,3 +878,214 @@ func httpRegisterAccount(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok."))
 	return
 }
+
+// httpImportAccount imports an existing account. The request body is the account key in PEM or JWK format.
+func httpImportAccount(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mailPtr := param("mail", q)
+	namePtr := param("name", q)
+
+	if mailPtr == nil || namePtr == nil || len(*mailPtr) == 0 || len(*namePtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	keyData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil {
+		logline("read key data error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	privKey, err := ParseAccountKey(keyData)
+	if err != nil {
+		logline("parse account key error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	if !validAccountMail(*mailPtr) {
+		logline("mail is illegal:", *mailPtr)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	exists, err := AccountExists(requestTenant(r), *mailPtr)
+	if err != nil {
+		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	if exists {
+		logline("account already exists:", *mailPtr)
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("account exists."))
+		return
+	}
+
+	caName := ""
+	if caPtr := param("ca", q); caPtr != nil {
+		caName = *caPtr
+	}
+	client, err := caClient(caName)
+	if err != nil {
+		logline("get ca client error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	acc, err := client.ImportAccount(r.Context(), privKey, []string{*mailPtr})
+	if err != nil {
+		logline("import account error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	acc.AccountName = *namePtr
+	acc.CaName = config.caProfile(caName).Name
+	acc.Tenant = requestTenant(r)
+
+	err = SaveAccount(*mailPtr, acc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok."))
+}
+
+func httpUpdateAccount(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// mail is the key of the account, contact can be given multiple times
+	mailPtr := param("mail", q)
+	contacts := q["contact"]
+
+	if mailPtr == nil || len(*mailPtr) == 0 || len(contacts) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	for _, v := range contacts {
+		if len(v) == 0 {
+			logline("contact is empty.")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("error occurs."))
+			return
+		}
+	}
+
+	acc, err := tenantAccount(r, *mailPtr)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	client, err := caClient(acc.CaName)
+	if err != nil {
+		logline("get ca client error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	acc, err = client.UpdateContacts(r.Context(), acc, contacts)
+	if err != nil {
+		logline("update contacts error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	err = SaveAccount(*mailPtr, acc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok."))
+}
+
+func httpDeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mailPtr := param("mail", q)
+	if mailPtr == nil || len(*mailPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	acc, err := tenantAccount(r, *mailPtr)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	client, err := caClient(acc.CaName)
+	if err != nil {
+		logline("get ca client error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	acc, err = client.DeactivateAccount(r.Context(), acc)
+	if err != nil {
+		logline("deactivate account error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	err = SaveAccount(*mailPtr, acc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok."))
+}
+
+func httpDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mailPtr := param("mail", q)
+	if mailPtr == nil || len(*mailPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	_, err := tenantAccount(r, *mailPtr)
+	if err != nil {
+		logline("query account error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	err = DeleteAccount(requestTenant(r), *mailPtr)
+	if err == ErrAccountInUse {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("account is still used by domains."))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok."))
+}
@@ -1,31 +1,172 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
-	"path/filepath"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/eggsampler/acme"
 )
 
-func StartJob() {
+// scan domains at least once within this duration, in case of changes without notification
+var schedulerMaxIdle = time.Minute
+
+var scheduler = &jobScheduler{
+	wakeup: make(chan struct{}, 1),
+	queue:  make(chan string),
+}
+
+// jobScheduler runs every domain at its next action time
+type jobScheduler struct {
+	wakeup chan struct{}
+	queue  chan string
+}
+
+// Notify wakes up the scheduler to pick up changed domains immediately
+func (this *jobScheduler) Notify() {
+	select {
+	case this.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// StartJob schedules domains until ctx is done and returns when all workers are finished.
+// In-flight domains are drained, acmeCtx interrupts their acme operations.
+func StartJob(ctx context.Context, acmeCtx context.Context) {
 
 	logline("start scheduling job...")
 
-	duration := 30 * time.Minute
-	// 4 hour per schedule
-	ticker := time.NewTicker(duration)
-	defer ticker.Stop()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < jobWorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domainKey := range scheduler.queue {
+				processDomain(acmeCtx, domainKey)
+				domainLocks.unlock(domainKey)
+				scheduler.Notify()
+			}
+		}()
+	}
 
-	for {
-		scheduleTime := <-ticker.C
-		logline("start processing jobs...", scheduleTime)
-		startJobProcessing()
-		logline("next schedule:", scheduleTime.Add(duration))
+	for ctx.Err() == nil {
+		wait := schedulerMaxIdle
+		next := startJobProcessing(ctx)
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-scheduler.wakeup:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	logline("stop scheduling job, waiting for in-flight domains...")
+	close(scheduler.queue)
+	wg.Wait()
+	logline("all jobs stopped.")
+}
+
+// number of domains processed in parallel
+var jobWorkerCount = 4
+
+var domainLocks = &domainLocker{running: make(map[string]bool)}
+
+// domainLocker makes sure that a domain is never processed twice at the same time
+type domainLocker struct {
+	lock    sync.Mutex
+	running map[string]bool
+}
+
+func (this *domainLocker) tryLock(domain string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.running[domain] {
+		return false
 	}
+	this.running[domain] = true
+	return true
 }
 
-func startJobProcessing() {
+func (this *domainLocker) unlock(domain string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.running, domain)
+}
+
+// nextActionTime returns when the job should process the domain next.
+// Failed domains are not processed until retried manually.
+func nextActionTime(domain *Domain) (time.Time, bool) {
+	switch domain.Status {
+	case IssueFailed:
+		return time.Time{}, false
+	case IssueAvailable:
+		expireTime, err := time.Parse(time.RFC3339Nano, domain.ExpireTime)
+		if err != nil {
+			return time.Time{}, false
+		}
+		actionTime := expireTime.Add(-renewBefore)
+		// scheduled key rotation may come before renewal
+		if domain.ReuseKey && domain.KeyRotationDays > 0 {
+			keyCreateTime, err := time.Parse(time.RFC3339Nano, domain.keyCreateTime())
+			if err == nil {
+				rotationTime := keyCreateTime.Add(time.Duration(domain.KeyRotationDays) * 24 * time.Hour)
+				if rotationTime.Before(actionTime) {
+					actionTime = rotationTime
+				}
+			}
+		}
+		// ocsp responses are refreshed at half validity
+		if len(domain.OcspRefreshTime) == 0 {
+			return time.Time{}, true
+		}
+		ocspRefreshTime, err := time.Parse(time.RFC3339Nano, domain.OcspRefreshTime)
+		if err != nil {
+			return time.Time{}, true
+		}
+		if ocspRefreshTime.Before(actionTime) {
+			actionTime = ocspRefreshTime
+		}
+		return actionTime, true
+	default:
+		var actionTime time.Time
+		if len(domain.NextAttemptTime) > 0 {
+			nextAttemptTime, err := time.Parse(time.RFC3339Nano, domain.NextAttemptTime)
+			if err != nil {
+				logline("parse next attempt time error:", domain.Domain, err)
+			} else {
+				actionTime = nextAttemptTime
+			}
+		}
+		// records not yet propagated are looked up again, retries of failures are not brought forward
+		if domain.Status == IssueChallenging && len(domain.PropagationCheckTime) > 0 {
+			checkTime, err := time.Parse(time.RFC3339Nano, domain.PropagationCheckTime)
+			if err != nil {
+				logline("parse propagation check time error:", domain.Domain, err)
+			} else if checkTime.After(actionTime) {
+				actionTime = checkTime
+			}
+		}
+		return actionTime, true
+	}
+}
+
+// startJobProcessing dispatches all due domains to the workers
+// and returns the earliest next action time of the other domains
+func startJobProcessing(ctx context.Context) (next time.Time) {
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -33,18 +174,14 @@ func startJobProcessing() {
 		}
 	}()
 
-	maxCnt := 10
-	domainList := make([]struct {
-		Domain *Domain
-		Key    []byte
-	}, 0, maxCnt)
+	var domainList []string
+	now := time.Now()
 
 	err := db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		prefix := []byte(DomainTablePrefix)
-		idx := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix) && idx < maxCnt; it.Next() {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			err := item.Value(func(v []byte) error {
 				domain := new(Domain)
@@ -52,12 +189,19 @@ func startJobProcessing() {
 				if err != nil {
 					return err
 				}
-				if domain.Status != IssueAvailable {
-					domainList = append(domainList, struct {
-						Domain *Domain
-						Key    []byte
-					}{Domain: domain, Key: item.Key()})
-					idx++
+				actionTime, ok := nextActionTime(domain)
+				if !ok {
+					return nil
+				}
+				if actionTime.After(now) {
+					if next.IsZero() || actionTime.Before(next) {
+						next = actionTime
+					}
+					return nil
+				}
+				// running domains notify the scheduler when done
+				if domainLocks.tryLock(domain.key()) {
+					domainList = append(domainList, domain.key())
 				}
 				return nil
 			})
@@ -70,83 +214,425 @@ func startJobProcessing() {
 
 	if err != nil {
 		logline("processing error.", err)
+		for _, v := range domainList {
+			domainLocks.unlock(v)
+		}
+		return next
+	}
+
+	for i, v := range domainList {
+		select {
+		case scheduler.queue <- v:
+		case <-ctx.Done():
+			for _, notDispatched := range domainList[i:] {
+				domainLocks.unlock(notDispatched)
+			}
+			return next
+		}
+	}
+	return next
+}
+
+// processDomain processes the domain given by its tenant key. The context interrupts acme operations.
+func processDomain(ctx context.Context, domainKey string) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			logline("processing domain:", domainKey, "panic:", err)
+		}
+	}()
+
+	// reload the domain since it may have been changed after scanning
+	domain, err := QueryDomain(domainKey)
+	if err == badger.ErrKeyNotFound {
+		return
+	}
+	if err != nil {
+		logline("query domain error:", domainKey, err)
 		return
 	}
 
-	for _, v := range domainList {
-		switch v.Domain.Status {
-		case IssuePending:
-			logline("[job] start processing pending domain:", v.Domain.Domain)
-			err := jobProcessPending(v.Domain.AccountMail, v.Domain)
-			if err != nil {
-				logline("process pending domain:", v.Domain.Domain, "error.", err)
+	actionTime, ok := nextActionTime(domain)
+	if !ok || actionTime.After(time.Now()) {
+		return
+	}
+
+	switch domain.Status {
+	case IssuePending:
+		logline("[job] start processing pending domain:", domain.Domain)
+		err := jobProcessPending(ctx, domain.AccountMail, domain)
+		if err != nil {
+			logline("process pending domain:", domain.Domain, "error.", err)
+			if ctx.Err() == nil {
+				jobRecordFailure(domain.key(), err)
 			}
-		case IssueChallenging:
-			logline("[job] start processing challenging domain:", v.Domain.Domain)
-			err := jobProcessChallenging(v.Domain.AccountMail, v.Domain)
+		}
+	case IssueChallenging:
+		if !challengePropagated(ctx, domain) {
+			domain.PropagationCheckTime = time.Now().Add(propagationCheckInterval).Format(time.RFC3339Nano)
+			err := UpdateDomainDirect(domain.key(), domain)
 			if err != nil {
-				logline("process challenging domain:", v.Domain.Domain, "error.", err)
+				logline("update domain propagation check error:", domain.Domain, err)
+				// the saved domain is still due, hold it until the next check instead of looking up again at once
+				timer := time.NewTimer(propagationCheckInterval)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+				}
+			}
+			return
+		}
+		logline("[job] start processing challenging domain:", domain.Domain)
+		err := jobProcessChallenging(ctx, domain.AccountMail, domain)
+		if err != nil {
+			logline("process challenging domain:", domain.Domain, "error.", err)
+			if ctx.Err() == nil {
+				jobRecordFailure(domain.key(), err)
 			}
-		case IssueAvailable:
-			//TODO check issue time. if already 4 months, try to reissue
-			logline("[job] start processing available domain:", v.Domain.Domain)
-		default:
-			logline("unknown domain status:", v.Domain.Status)
 		}
+	case IssueAvailable:
+		logline("[job] start processing available domain:", domain.Domain)
+		err := jobProcessAvailable(ctx, domain)
+		if err != nil {
+			logline("process available domain:", domain.Domain, "error.", err)
+		}
+	case IssueFailed:
+		// waiting for manual retry
+	default:
+		logline("unknown domain status:", domain.Status)
 	}
 }
 
-func jobProcessChallenging(mail string, domain *Domain) error {
-	acc, err := QueryAccountByMail(mail)
+// max attempts before a domain is marked as failed
+var jobMaxAttempts = 5
+
+var (
+	retryBaseDelay = 5 * time.Minute
+	retryMaxDelay  = 12 * time.Hour
+)
+
+// retryDelay is an exponential backoff with +/-20% jitter
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(delay))
+	return delay + jitter
+}
+
+// jobRecordFailure counts the failed attempt and schedules the next one.
+// The domain is marked as failed after jobMaxAttempts attempts.
+func jobRecordFailure(domainKey string, cause error) {
+	// reload since the failed step may have rolled back the domain
+	domain, err := QueryDomain(domainKey)
+	if err != nil {
+		logline("query domain for recording failure error:", domainKey, err)
+		return
+	}
+
+	domain.LastError = cause.Error()
+	domain.LastProblem = problemOf(cause)
+	// rate limited by the CA is not an attempt of the domain
+	if retryTime, ok := rateLimitedUntil(cause); ok {
+		rateLimitedRetry(domain, retryTime)
+		err = UpdateDomainDirect(domainKey, domain)
+		if err != nil {
+			logline("update domain failure error:", domainKey, err)
+		}
+		return
+	}
+
+	// retrying a CA forbidden by caa records does not help
+	caaForbidden := domain.LastProblem != nil && domain.LastProblem.Type == caaProblemType
+
+	domain.Attempts++
+	if next := nextAccount(domain); len(next) > 0 && (caaForbidden || domain.Attempts >= failoverAfter(domain.Tenant, domain.AccountMail)) {
+		fallBack(domain, next)
+	} else if caaForbidden || domain.Attempts >= jobMaxAttempts {
+		logline("[job] domain failed after", domain.Attempts, "attempts:", domainKey)
+		domain.Status = IssueFailed
+		domain.NextAttemptTime = ""
+	} else {
+		domain.NextAttemptTime = time.Now().Add(retryDelay(domain.Attempts)).Format(time.RFC3339Nano)
+	}
+
+	err = UpdateDomainDirect(domainKey, domain)
+	if err != nil {
+		logline("update domain failure error:", domainKey, err)
+	}
+}
+
+// rateLimitedRetry falls back to the next account at once since waiting for the limit
+// of the current account does not help, the last account waits until the retry time
+func rateLimitedRetry(domain *Domain, retryTime time.Time) {
+	if next := nextAccount(domain); len(next) > 0 {
+		logline("[job] rate limited until", retryTime, "domain:", domain.Domain)
+		fallBack(domain, next)
+		return
+	}
+	logline("[job] rate limited, retry domain:", domain.Domain, "after", retryTime)
+	domain.NextAttemptTime = retryTime.Format(time.RFC3339Nano)
+}
+
+func fallBack(domain *Domain, next string) {
+	logline("[job] fall back to account", next, "for domain:", domain.Domain)
+	// the order belongs to the previous account
+	clearOrder(domain)
+	domain.AccountMail = next
+	domain.Status = IssuePending
+	domain.Attempts = 0
+	domain.NextAttemptTime = ""
+}
+
+// nextAccount returns the account after the one in use, empty if there is none
+func nextAccount(domain *Domain) string {
+	for i, v := range domain.AccountList {
+		if v == domain.AccountMail && i+1 < len(domain.AccountList) {
+			return domain.AccountList[i+1]
+		}
+	}
+	return ""
+}
+
+// failoverAfter returns the failures before falling back from the CA of the account
+func failoverAfter(tenant string, mail string) int {
+	acc, err := QueryAccountByMail(tenant, mail)
+	if err != nil {
+		return jobMaxAttempts
+	}
+	profile := config.caProfile(acc.CaName)
+	if profile == nil {
+		return jobMaxAttempts
+	}
+	return profile.FailoverAfter
+}
+
+func resetAttempts(domain *Domain) {
+	domain.Attempts = 0
+	domain.LastError = ""
+	domain.LastProblem = nil
+	domain.NextAttemptTime = ""
+}
+
+// poll interval of orders processed by the CA
+var orderPollInterval = 10 * time.Second
+
+// jobProcessChallenging continues the order from its actual status at the CA
+// until the certificate is fetched. Every step is persisted before the next one.
+func jobProcessChallenging(ctx context.Context, mail string, domain *Domain) error {
+	acc, err := QueryAccountByMail(domain.Tenant, mail)
 	if err != nil {
 		logline("invoke QueryAccountByMail error:", err)
 		return err
 	}
 
-	//acc, err = client.LoadAccount(acc)
-	//if err != nil {
-	//	logline("load account error:", err)
-	//	return err
-	//}
-
-	priv, cert, err := client.UpdateChallenge(acc, domain)
+	client, err := caClient(acc.CaName)
 	if err != nil {
-		logline("update challeging error when do acme operations:", err)
-		// rollback status to pending in order to redo challenge work
-		// If we can recognize whether we should redo challenge, this code could be changed
+		return err
+	}
+	acc, err = client.LoadAccount(ctx, acc)
+	if err != nil {
+		logline("load account error:", err)
+		return err
+	}
+
+	if len(domain.OrderUrl) == 0 {
+		// saved before order urls were recorded, redo challenge work with a new order
+		logline("no order url, rollback to pending:", domain.Domain)
+		clearOrder(domain)
 		domain.Status = IssuePending
-		// update db
-		domainData, _ := json.Marshal(domain)
-		err2 := db.Update(func(txn *badger.Txn) error {
-			return txn.Set(DomainTable(domain.Domain), domainData)
-		})
-		if err2 != nil {
-			logline("update domain to pending error for domain rollback:", domain.Domain)
-			return err2
-		}
+		return UpdateDomainDirect(domain.key(), domain)
+	}
+
+	order, err := client.FetchOrder(ctx, acc, domain.OrderUrl)
+	if err != nil {
 		return err
 	}
 
-	//TODO need remove
-	logline("private file:" + string(priv))
-	logline("cert file:" + string(cert))
+	for {
+		switch order.Status {
+		case OrderPending:
+			err = client.UpdateChallenge(ctx, acc, domain)
+			if err != nil && ctx.Err() != nil {
+				// interrupted by shutdown, continue challenging after restart
+				return err
+			}
+			if err != nil {
+				logline("update challeging error when do acme operations:", err)
+				cleanupDnsChallenges(ctx, domain)
+				if pe, ok := err.(*ProblemError); ok && len(pe.Identifier) > 0 {
+					config.caProfile(acc.CaName).rateLimit(failedValidationLimit).recordEvent(tenantKey(domain.Tenant, mail) + "/" + pe.Identifier)
+				}
+				// rollback status to pending in order to redo challenge work
+				// If we can recognize whether we should redo challenge, this code could be changed
+				domain.Status = IssuePending
+				// update db
+				err2 := UpdateDomainDirect(domain.key(), domain)
+				if err2 != nil {
+					logline("update domain to pending error for domain rollback:", domain.Domain)
+					return err2
+				}
+				return err
+			}
+			order, err = client.FetchOrder(ctx, acc, domain.OrderUrl)
+			if err != nil {
+				return err
+			}
+			auths, err := client.FetchAuthorizations(ctx, acc, order)
+			if err == nil {
+				SaveAuthorizations(authorizationRecords(domain.Tenant, mail, auths))
+			}
+			if order.Status != OrderPending {
+				// all authorizations are validated
+				cleanupDnsChallenges(ctx, domain)
+			}
+			if order.Status == OrderPending {
+				// authorizations are still being validated
+				domain.NextAttemptTime = time.Now().Add(orderPollInterval).Format(time.RFC3339Nano)
+				return UpdateDomainDirect(domain.key(), domain)
+			}
+		case OrderReady:
+			csr, err := orderCertificateRequest(domain, config.caProfile(acc.CaName))
+			if err != nil {
+				return err
+			}
+			order, err = client.FinalizeOrder(ctx, acc, order, csr)
+			if err != nil {
+				return err
+			}
+		case OrderProcessing:
+			domain.NextAttemptTime = time.Now().Add(orderPollInterval).Format(time.RFC3339Nano)
+			return UpdateDomainDirect(domain.key(), domain)
+		case OrderValid:
+			if len(domain.CsrPem) == 0 && len(domain.OrderPrivateKeyString) == 0 {
+				// the certificate can not be used without its key
+				clearOrder(domain)
+				domain.Status = IssuePending
+				err = UpdateDomainDirect(domain.key(), domain)
+				if err != nil {
+					return err
+				}
+				return errors.New("private key of valid order is lost")
+			}
+			cert, err := client.FetchCertificate(ctx, acc, order)
+			if err != nil {
+				return err
+			}
+			return jobCompleteDomain(domain, acc, cert)
+		default:
+			logline("order is", order.Status, "rollback to pending:", domain.Domain)
+			cleanupDnsChallenges(ctx, domain)
+			clearOrder(domain)
+			domain.Status = IssuePending
+			err = UpdateDomainDirect(domain.key(), domain)
+			if err != nil {
+				return err
+			}
+			return &ProblemError{
+				Message: "order is " + order.Status,
+				Problem: order.Error,
+			}
+		}
+	}
+}
+
+// writeCertificateFiles writes timestamped copies of the certificate and the key,
+// and the certificate to the stable path served together with the ocsp file.
+// privKey is nil when the key is not known.
+func writeCertificateFiles(domain *Domain, cert []byte, privKey crypto.Signer) error {
+	now := time.Now().Format(time.RFC3339Nano)
+	if privKey != nil {
+		keyFile, err := outputPath(domain, "_"+now+".key")
+		if err != nil {
+			return err
+		}
+		err = WritePemPrivateKeyFile(keyFile, privKey)
+		if err != nil {
+			logline("write private key error.", err)
+			return err
+		}
+	}
+	certFile, err := outputPath(domain, "_"+now+".cert")
+	if err != nil {
+		return err
+	}
+	err = WritePemCertFile(certFile, cert)
+	if err != nil {
+		logline("write cert error.", err)
+		return err
+	}
 
-	// write files
-	err = WritePemPrivateKeyFile(filepath.Join("certs", domain.Domain+"_"+time.Now().Format(time.RFC3339Nano))+".key", priv)
+	// the ocsp response of the previous certificate must not be stapled to the new one
+	ocspFile, err := OcspFilePath(domain)
 	if err != nil {
-		logline("write private key error.", err)
 		return err
 	}
-	err = WritePemCertFile(filepath.Join("certs", domain.Domain+"_"+time.Now().Format(time.RFC3339Nano))+".cert", priv)
+	err = os.Remove(ocspFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	certFile, err = CertFilePath(domain)
+	if err != nil {
+		return err
+	}
+	err = WritePemCertFile(certFile, cert)
 	if err != nil {
 		logline("write cert error.", err)
 		return err
 	}
+	return nil
+}
+
+// jobCompleteDomain saves the issued certificate and makes the domain available
+func jobCompleteDomain(domain *Domain, acc *Account, cert []byte) error {
+	// write files, the key of a submitted csr is not known
+	var privKey crypto.Signer
+	if len(domain.CsrPem) == 0 {
+		key, err := decodePrivateKey(domain.OrderPrivateKeyString)
+		if err != nil {
+			return err
+		}
+		privKey = key
+	}
+	err := writeCertificateFiles(domain, cert, privKey)
+	if err != nil {
+		return err
+	}
+
+	certRecord, err := NewCertificateRecord(domain.Domain, CertificateIssued, cert, domain.OrderPrivateKeyString)
+	if err != nil {
+		logline("create certificate record error.", err)
+		return err
+	}
+	profile := config.caProfile(acc.CaName)
+	certRecord.Tenant = domain.Tenant
+	certRecord.CaName = profile.Name
+	certRecord.AccountMail = domain.AccountMail
+	err = SaveCertificate(domain.key(), certRecord)
+	if err != nil {
+		return err
+	}
+	recordCertificateIssued(domain, profile)
 
 	domain.Status = IssueAvailable
 	domain.IssueTime = time.Now().Format(time.RFC3339Nano)
+	domain.ExpireTime = certRecord.NotAfter
+	resetAttempts(domain)
+	clearOrder(domain)
+	// staple the new certificate
+	domain.OcspRefreshTime = ""
+	domain.Revoked = false
+	// renew with the primary account again
+	if len(domain.AccountList) > 0 {
+		domain.AccountMail = domain.AccountList[0]
+	}
 	// update db
-	err = UpdateDomainDirect(domain.Domain, domain)
+	err = UpdateDomainDirect(domain.key(), domain)
 	if err != nil {
 		logline("update domain to available error for domain:", domain.Domain)
 		return err
@@ -154,34 +640,188 @@ func jobProcessChallenging(mail string, domain *Domain) error {
 	return nil
 }
 
-func jobProcessPending(mail string, domain *Domain) error {
-	acc, err := QueryAccountByMail(mail)
+// orderCertificateRequest returns the submitted csr, or the csr of the order key.
+// The key is persisted before finalizing since the certificate is useless without it.
+func orderCertificateRequest(domain *Domain, profile *CaProfile) (*x509.CertificateRequest, error) {
+	if len(domain.CsrPem) > 0 {
+		return parseCertificateRequest(domain.CsrPem)
+	}
+
+	if len(domain.OrderPrivateKeyString) == 0 {
+		keyString, keyCreateTime, err := orderKey(domain)
+		if err != nil {
+			return nil, err
+		}
+		domain.OrderPrivateKeyString = keyString
+		domain.KeyCreateTime = keyCreateTime
+		err = UpdateDomainDirect(domain.key(), domain)
+		if err != nil {
+			logline("save order private key error:", domain.Domain)
+			return nil, err
+		}
+	}
+	privKey, err := decodePrivateKey(domain.OrderPrivateKeyString)
+	if err != nil {
+		return nil, err
+	}
+	return CreateCertificateRequest(privKey, domain.Domain, domain.Names(), domain.CsrOptions, profile != nil && profile.SubjectFields)
+}
+
+// orderKey returns the key of the current certificate if the domain reuses keys
+// and the key is not due for rotation, otherwise a new key
+func orderKey(domain *Domain) (keyString string, keyCreateTime string, err error) {
+	if domain.ReuseKey && !domain.Revoked && !keyRotationDue(domain, time.Now()) {
+		cert, err := QueryCertificate(domain.key())
+		if err != nil && err != badger.ErrKeyNotFound {
+			return "", "", err
+		}
+		if err == nil && len(cert.PrivateKeyString) > 0 {
+			logline("[job] reuse private key of current certificate:", domain.Domain)
+			keyCreateTime = domain.KeyCreateTime
+			if len(keyCreateTime) == 0 {
+				keyCreateTime = cert.NotBefore
+			}
+			return cert.PrivateKeyString, keyCreateTime, nil
+		}
+	}
+
+	_, privKeyData, err := GenerateECDSA256Key()
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(privKeyData), time.Now().Format(time.RFC3339Nano), nil
+}
+
+// keyCreateTime returns the create time of the current key,
+// keys of unknown age are as old as the certificate, like keys of imported certificates saved without it
+func (this *Domain) keyCreateTime() string {
+	if len(this.KeyCreateTime) > 0 {
+		return this.KeyCreateTime
+	}
+	return this.IssueTime
+}
+
+// keyRotationDue checks whether the reused key is older than the rotation interval of the domain
+func keyRotationDue(domain *Domain, now time.Time) bool {
+	if domain.KeyRotationDays <= 0 || len(domain.keyCreateTime()) == 0 {
+		return false
+	}
+	keyCreateTime, err := time.Parse(time.RFC3339Nano, domain.keyCreateTime())
+	if err != nil {
+		logline("parse key create time error:", domain.Domain, err)
+		return true
+	}
+	return now.Sub(keyCreateTime) >= time.Duration(domain.KeyRotationDays)*24*time.Hour
+}
+
+func clearOrder(domain *Domain) {
+	domain.OrderUrl = ""
+	domain.OrderData = ""
+	domain.OrderPrivateKeyString = ""
+	domain.ChallengeData = ""
+	domain.PropagationCheckTime = ""
+}
+
+// jobProcessPending creates the order, or resumes the order created before restart
+func jobProcessPending(ctx context.Context, mail string, domain *Domain) error {
+	acc, err := QueryAccountByMail(domain.Tenant, mail)
 	if err != nil {
 		logline("invoke QueryAccountByMail error:", err)
 		return err
 	}
 
-	acc, err = client.LoadAccount(acc)
+	client, err := caClient(acc.CaName)
 	if err != nil {
-		logline("load account error:", err)
 		return err
 	}
-
-	orderdata, chaldata, token, err := client.AcquireChallenging(acc, domain)
+	acc, err = client.LoadAccount(ctx, acc)
 	if err != nil {
-		logline("acquire challenging error:", err)
+		logline("load account error:", err)
 		return err
 	}
-	domain.ChallengeData = string(chaldata)
-	domain.OrderData = string(orderdata)
-	//TODO update token to dns provider
-	logline("acquired token:", token)
+
+	var order acme.Order
+	if len(domain.OrderUrl) > 0 {
+		order, err = client.FetchOrder(ctx, acc, domain.OrderUrl)
+		if err != nil {
+			return err
+		}
+		if order.Status == OrderInvalid || (!order.Expires.IsZero() && order.Expires.Before(time.Now())) {
+			logline("order is", order.Status, "create a new one:", domain.Domain)
+			clearOrder(domain)
+		}
+	}
+	if len(domain.OrderUrl) == 0 {
+		// defer the order instead of exceeding limits of the CA
+		deferTime, reason := checkRateLimits(domain, config.caProfile(acc.CaName))
+		if !deferTime.IsZero() {
+			logline("[job] defer order of domain:", domain.Domain, reason, "until", deferTime)
+			domain.LastError = reason
+			rateLimitedRetry(domain, deferTime)
+			return UpdateDomainDirect(domain.key(), domain)
+		}
+
+		err = checkCaa(ctx, domain, config.caProfile(acc.CaName), acc.AccountUrl)
+		if err != nil {
+			logline("caa check error:", domain.Domain, err)
+			return err
+		}
+
+		order, err = client.NewOrder(ctx, acc, domain)
+		if err != nil {
+			logline("new order error:", err)
+			return err
+		}
+		config.caProfile(acc.CaName).rateLimit(newOrdersLimit).recordEvent(tenantKey(domain.Tenant, mail))
+		o, _ := json.Marshal(order)
+		domain.OrderUrl = order.URL
+		domain.OrderData = string(o)
+		// persist the order before further steps
+		err = UpdateDomainDirect(domain.key(), domain)
+		if err != nil {
+			logline("save order error for domain:", domain.Domain)
+			return err
+		}
+	}
+
+	if order.Status == OrderPending {
+		auths, err := client.FetchAuthorizations(ctx, acc, order)
+		if err != nil {
+			return err
+		}
+		SaveAuthorizations(authorizationRecords(domain.Tenant, mail, auths))
+		chaldata, tokens, err := AcquireChallenging(auths, domain.ChallengeType)
+		if _, ok := err.(*ProblemError); ok {
+			// the order can not be completed anymore, create a new one next time
+			logline("acquire challenging error, drop order:", err)
+			clearOrder(domain)
+			err2 := UpdateDomainDirect(domain.key(), domain)
+			if err2 != nil {
+				return err2
+			}
+			return err
+		}
+		if err != nil {
+			logline("acquire challenging error:", err)
+			return err
+		}
+		domain.ChallengeData = string(chaldata)
+		logline("acquired tokens:", tokens)
+		err = publishDnsChallenges(ctx, domain)
+		if err != nil {
+			return err
+		}
+	} else {
+		// ready/processing/valid orders need no challenge
+		domain.ChallengeData = ""
+	}
 
 	// update status to challenging
 	domain.Status = IssueChallenging
+	domain.ChallengeTime = time.Now().Format(time.RFC3339Nano)
 
 	// update db
-	err = UpdateDomainDirect(domain.Domain, domain)
+	err = UpdateDomainDirect(domain.key(), domain)
 	if err != nil {
 		logline("update domain to challenging error for domain:", domain.Domain)
 		return err
@@ -189,3 +829,33 @@ func jobProcessPending(mail string, domain *Domain) error {
 
 	return nil
 }
+
+// jobProcessAvailable starts renewal of a certificate which is going to expire
+// or whose reused key is due for rotation
+func jobProcessAvailable(ctx context.Context, domain *Domain) error {
+	if ocspDue(domain, time.Now()) {
+		revoked, err := refreshOcsp(ctx, domain)
+		if err != nil {
+			logline("refresh ocsp error:", domain.Domain, err)
+		}
+		if revoked {
+			logline("[job] certificate revoked, reissue immediately:", domain.Domain)
+			domain.Revoked = true
+		}
+	}
+
+	rotateKey := domain.ReuseKey && keyRotationDue(domain, time.Now())
+	if !needRenew(domain) && !rotateKey && !domain.Revoked {
+		// keep the ocsp refresh time
+		return UpdateDomainDirect(domain.key(), domain)
+	}
+	logline("[job] renew domain:", domain.Domain, "expire time:", domain.ExpireTime, "rotate key:", rotateKey, "revoked:", domain.Revoked)
+
+	domain.Status = IssuePending
+	err := UpdateDomainDirect(domain.key(), domain)
+	if err != nil {
+		logline("update domain to pending error for domain renewal:", domain.Domain)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eggsampler/acme"
+)
+
+func TestRetryDelay(t *testing.T) {
+	expected := []time.Duration{
+		5 * time.Minute,
+		10 * time.Minute,
+		20 * time.Minute,
+		40 * time.Minute,
+		80 * time.Minute,
+	}
+	for i, want := range expected {
+		attempts := i + 1
+		// the jitter is +/-20%
+		for n := 0; n < 20; n++ {
+			got := retryDelay(attempts)
+			if got < want*8/10 || got > want*12/10 {
+				t.Fatalf("retryDelay(%d) = %v, want %v +/-20%%", attempts, got, want)
+			}
+		}
+	}
+
+	for _, attempts := range []int{10, 100} {
+		got := retryDelay(attempts)
+		if got < retryMaxDelay*8/10 || got > retryMaxDelay*12/10 {
+			t.Errorf("retryDelay(%d) = %v, want capped at %v", attempts, got, retryMaxDelay)
+		}
+	}
+}
+
+func TestNextActionTime(t *testing.T) {
+	now := time.Now().Round(0)
+	expire := now.Add(90 * 24 * time.Hour)
+	ocspRefresh := now.Add(80 * 24 * time.Hour).Format(time.RFC3339Nano)
+	tests := map[string]struct {
+		domain *Domain
+		want   time.Time
+		due    bool
+	}{
+		"new domain":         {&Domain{Status: IssuePending}, time.Time{}, true},
+		"challenging":        {&Domain{Status: IssueChallenging}, time.Time{}, true},
+		"backoff":            {&Domain{Status: IssuePending, NextAttemptTime: now.Add(time.Hour).Format(time.RFC3339Nano)}, now.Add(time.Hour), true},
+		"illegal backoff":    {&Domain{Status: IssuePending, NextAttemptTime: "later"}, time.Time{}, true},
+		"propagation check":  {&Domain{Status: IssueChallenging, PropagationCheckTime: now.Add(time.Minute).Format(time.RFC3339Nano)}, now.Add(time.Minute), true},
+		"retry after check":  {&Domain{Status: IssueChallenging, NextAttemptTime: now.Add(time.Hour).Format(time.RFC3339Nano), PropagationCheckTime: now.Add(time.Minute).Format(time.RFC3339Nano)}, now.Add(time.Hour), true},
+		"check of old order": {&Domain{Status: IssuePending, PropagationCheckTime: now.Add(time.Minute).Format(time.RFC3339Nano)}, time.Time{}, true},
+		"available":          {&Domain{Status: IssueAvailable, ExpireTime: expire.Format(time.RFC3339Nano), OcspRefreshTime: ocspRefresh}, expire.Add(-renewBefore), true},
+		"ocsp refresh":       {&Domain{Status: IssueAvailable, ExpireTime: expire.Format(time.RFC3339Nano), OcspRefreshTime: now.Add(time.Hour).Format(time.RFC3339Nano)}, now.Add(time.Hour), true},
+		"ocsp never fetched": {&Domain{Status: IssueAvailable, ExpireTime: expire.Format(time.RFC3339Nano)}, time.Time{}, true},
+		"available no time":  {&Domain{Status: IssueAvailable}, time.Time{}, false},
+		"failed":             {&Domain{Status: IssueFailed, NextAttemptTime: now.Format(time.RFC3339Nano)}, time.Time{}, false},
+	}
+	for name, test := range tests {
+		got, due := nextActionTime(test.domain)
+		if due != test.due || !got.Equal(test.want) {
+			t.Errorf("%s: nextActionTime = %v, %v, want %v, %v", name, got, due, test.want, test.due)
+		}
+	}
+}
+
+func TestJobRecordFailure(t *testing.T) {
+	openTestDb(t)
+	domain := &Domain{Domain: "example.com", Status: IssuePending}
+	err := UpdateDomainDirect(domain.Domain, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt < jobMaxAttempts; attempt++ {
+		before := time.Now()
+		jobRecordFailure(domain.Domain, errors.New("validation error"))
+		domain, err = QueryDomain("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if domain.Attempts != attempt || domain.Status != IssuePending || domain.LastError != "validation error" {
+			t.Fatalf("attempt %d: domain is %s after %d attempts, last error %q", attempt, domain.Status, domain.Attempts, domain.LastError)
+		}
+		next, err := time.Parse(time.RFC3339Nano, domain.NextAttemptTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the doubled base delay less the jitter of 20%
+		minDelay := retryBaseDelay << uint(attempt-1) * 8 / 10
+		if next.Before(before.Add(minDelay)) {
+			t.Errorf("attempt %d: next attempt at %v is too early", attempt, next)
+		}
+	}
+
+	jobRecordFailure(domain.Domain, errors.New("validation error"))
+	domain, _ = QueryDomain("example.com")
+	if domain.Status != IssueFailed || len(domain.NextAttemptTime) != 0 {
+		t.Errorf("domain is %s with next attempt %q after %d attempts, want failed", domain.Status, domain.NextAttemptTime, domain.Attempts)
+	}
+
+	resetAttempts(domain)
+	if domain.Attempts != 0 || len(domain.LastError) != 0 || len(domain.NextAttemptTime) != 0 {
+		t.Errorf("attempts are not reset: %+v", domain)
+	}
+}
+
+// useTestConfig replaces the config for the test
+func useTestConfig(t *testing.T, c *Config) {
+	saved := config
+	config = c
+	t.Cleanup(func() {
+		config = saved
+	})
+}
+
+func TestNextAccount(t *testing.T) {
+	domain := &Domain{AccountList: []string{"a@example.com", "b@example.com", "c@example.com"}}
+	for mail, want := range map[string]string{
+		"a@example.com": "b@example.com",
+		"b@example.com": "c@example.com",
+		"c@example.com": "",
+		"x@example.com": "",
+	} {
+		domain.AccountMail = mail
+		if got := nextAccount(domain); got != want {
+			t.Errorf("nextAccount after %s = %q, want %q", mail, got, want)
+		}
+	}
+}
+
+func TestJobRecordFailureFailover(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{CaProfiles: []*CaProfile{
+		{Name: "primary", DirectoryUrl: "https://primary.example/directory", FailoverAfter: 2},
+		{Name: "secondary", DirectoryUrl: "https://secondary.example/directory", FailoverAfter: 2},
+	}})
+	_ = SaveAccount("a@example.com", &Account{CaName: "primary"})
+	_ = SaveAccount("b@example.com", &Account{CaName: "secondary"})
+
+	domain := &Domain{
+		Domain:      "example.com",
+		AccountMail: "a@example.com",
+		AccountList: []string{"a@example.com", "b@example.com"},
+		Status:      IssueChallenging,
+		OrderUrl:    "https://primary.example/order/1",
+	}
+	_ = UpdateDomainDirect(domain.Domain, domain)
+
+	jobRecordFailure(domain.Domain, errors.New("order error"))
+	domain, _ = QueryDomain(domain.Domain)
+	if domain.AccountMail != "a@example.com" || domain.Attempts != 1 {
+		t.Fatalf("failed over after 1 attempt: %s, %d attempts", domain.AccountMail, domain.Attempts)
+	}
+
+	jobRecordFailure(domain.Domain, errors.New("order error"))
+	domain, _ = QueryDomain(domain.Domain)
+	if domain.AccountMail != "b@example.com" || domain.Attempts != 0 || domain.Status != IssuePending || len(domain.NextAttemptTime) != 0 {
+		t.Fatalf("no fail over after 2 attempts: %s is %s, %d attempts", domain.AccountMail, domain.Status, domain.Attempts)
+	}
+	if len(domain.OrderUrl) != 0 {
+		t.Error("order of the previous account is kept")
+	}
+
+	// the last account fails the domain after max attempts
+	for i := 0; i < jobMaxAttempts; i++ {
+		jobRecordFailure(domain.Domain, errors.New("order error"))
+	}
+	domain, _ = QueryDomain(domain.Domain)
+	if domain.AccountMail != "b@example.com" || domain.Status != IssueFailed {
+		t.Errorf("last account %s is %s after %d attempts, want failed", domain.AccountMail, domain.Status, domain.Attempts)
+	}
+}
+
+func TestJobRecordFailureRateLimited(t *testing.T) {
+	openTestDb(t)
+	domain := &Domain{
+		Domain:      "example.com",
+		AccountMail: "a@example.com",
+		AccountList: []string{"a@example.com", "b@example.com"},
+		Status:      IssuePending,
+		Attempts:    1,
+		OrderUrl:    "https://primary.example/order/1",
+	}
+	_ = UpdateDomainDirect(domain.Domain, domain)
+	retryAfter := time.Now().Add(3 * time.Hour).Round(time.Second)
+	rateLimited := &ProblemError{
+		Message:    "new order",
+		Problem:    acme.Problem{Type: rateLimitedProblemType, Detail: "too many new orders"},
+		RetryAfter: retryAfter,
+	}
+
+	// the limit of the account does not hold back the fallback account
+	jobRecordFailure(domain.Domain, rateLimited)
+	domain, _ = QueryDomain(domain.Domain)
+	if domain.AccountMail != "b@example.com" || domain.Status != IssuePending || domain.Attempts != 0 || len(domain.NextAttemptTime) != 0 {
+		t.Fatalf("rate limited domain did not fall back: %s is %s, %d attempts, next attempt %q", domain.AccountMail, domain.Status, domain.Attempts, domain.NextAttemptTime)
+	}
+	if len(domain.OrderUrl) != 0 {
+		t.Error("order of the rate limited account is kept")
+	}
+
+	// the last account waits for the limit without counting an attempt
+	jobRecordFailure(domain.Domain, rateLimited)
+	domain, _ = QueryDomain(domain.Domain)
+	if domain.AccountMail != "b@example.com" || domain.Attempts != 0 || domain.NextAttemptTime != retryAfter.Format(time.RFC3339Nano) {
+		t.Errorf("last account %s with %d attempts retries at %q, want %v", domain.AccountMail, domain.Attempts, domain.NextAttemptTime, retryAfter)
+	}
+}
+
+func TestRateLimitedRetry(t *testing.T) {
+	deferTime := time.Now().Add(time.Hour)
+	domain := &Domain{
+		Domain:      "example.com",
+		AccountMail: "a@example.com",
+		AccountList: []string{"a@example.com", "b@example.com"},
+		Status:      IssuePending,
+	}
+
+	// orders deferred by local limits fall back as well
+	rateLimitedRetry(domain, deferTime)
+	if domain.AccountMail != "b@example.com" || len(domain.NextAttemptTime) != 0 {
+		t.Errorf("deferred domain uses %s, next attempt %q", domain.AccountMail, domain.NextAttemptTime)
+	}
+	rateLimitedRetry(domain, deferTime)
+	if domain.AccountMail != "b@example.com" || domain.NextAttemptTime != deferTime.Format(time.RFC3339Nano) {
+		t.Errorf("deferred last account %s, next attempt %q", domain.AccountMail, domain.NextAttemptTime)
+	}
+}
+
+func TestKeyRotationDue(t *testing.T) {
+	now := time.Now()
+	created := func(days int) string {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).Format(time.RFC3339Nano)
+	}
+	tests := map[string]struct {
+		domain *Domain
+		want   bool
+	}{
+		"no rotation":         {&Domain{KeyRotationDays: 0, KeyCreateTime: created(400)}, false},
+		"unknown key age":     {&Domain{KeyRotationDays: 30}, false},
+		"young key":           {&Domain{KeyRotationDays: 30, KeyCreateTime: created(29)}, false},
+		"key of the day":      {&Domain{KeyRotationDays: 30, KeyCreateTime: created(30)}, true},
+		"old key":             {&Domain{KeyRotationDays: 30, KeyCreateTime: created(90)}, true},
+		"illegal create time": {&Domain{KeyRotationDays: 30, KeyCreateTime: "long ago"}, true},
+		// keys of imported certificates are as old as the certificate
+		"old imported key":   {&Domain{KeyRotationDays: 30, IssueTime: created(45)}, true},
+		"young imported key": {&Domain{KeyRotationDays: 30, IssueTime: created(10)}, false},
+	}
+	for name, test := range tests {
+		if got := keyRotationDue(test.domain, now); got != test.want {
+			t.Errorf("%s: keyRotationDue = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestNextActionTimeKeyRotation(t *testing.T) {
+	now := time.Now().Round(0)
+	domain := &Domain{
+		Status:          IssueAvailable,
+		ExpireTime:      now.Add(80 * 24 * time.Hour).Format(time.RFC3339Nano),
+		ReuseKey:        true,
+		KeyRotationDays: 20,
+		KeyCreateTime:   now.Format(time.RFC3339Nano),
+		OcspRefreshTime: now.Add(365 * 24 * time.Hour).Format(time.RFC3339Nano),
+	}
+	next, _ := nextActionTime(domain)
+	if want := now.Add(20 * 24 * time.Hour); !next.Equal(want) {
+		t.Errorf("next action of rotation = %v, want %v", next, want)
+	}
+
+	// renewal before rotation
+	domain.KeyRotationDays = 60
+	next, _ = nextActionTime(domain)
+	if want := now.Add(80*24*time.Hour - renewBefore); !next.Equal(want) {
+		t.Errorf("next action of renewal = %v, want %v", next, want)
+	}
+
+	// rotation of imported keys counts from the certificate
+	domain.KeyRotationDays = 20
+	domain.KeyCreateTime = ""
+	domain.IssueTime = now.Add(-5 * 24 * time.Hour).Format(time.RFC3339Nano)
+	next, _ = nextActionTime(domain)
+	if want := now.Add(15 * 24 * time.Hour); !next.Equal(want) {
+		t.Errorf("next action of imported key rotation = %v, want %v", next, want)
+	}
+
+	// rotation without key reuse happens on every renewal
+	domain.ReuseKey = false
+	domain.KeyRotationDays = 20
+	next, _ = nextActionTime(domain)
+	if want := now.Add(80*24*time.Hour - renewBefore); !next.Equal(want) {
+		t.Errorf("next action without key reuse = %v, want %v", next, want)
+	}
+}
+
+func TestOrderKeyReuse(t *testing.T) {
+	openTestDb(t)
+	keyCreateTime := time.Now().Add(-10 * 24 * time.Hour).Format(time.RFC3339Nano)
+	_ = SaveCertificate("example.com", &Certificate{Domain: "example.com", PrivateKeyString: "current key", NotBefore: keyCreateTime})
+
+	domain := &Domain{Domain: "example.com", ReuseKey: true, KeyRotationDays: 30, KeyCreateTime: keyCreateTime}
+	key, created, err := orderKey(domain)
+	if err != nil || key != "current key" || created != keyCreateTime {
+		t.Errorf("reused key = %q created %s, %v", key, created, err)
+	}
+
+	// the certificate time is used for keys of unknown age
+	domain.KeyCreateTime = ""
+	_, created, _ = orderKey(domain)
+	if created != keyCreateTime {
+		t.Errorf("create time of reused key = %s, want %s", created, keyCreateTime)
+	}
+
+	for name, v := range map[string]*Domain{
+		"rotation due": {Domain: "example.com", ReuseKey: true, KeyRotationDays: 5, KeyCreateTime: keyCreateTime},
+		"no reuse":     {Domain: "example.com"},
+		"no cert":      {Domain: "example.org", ReuseKey: true},
+	} {
+		key, _, err := orderKey(v)
+		if err != nil || key == "current key" || len(key) == 0 {
+			t.Errorf("%s: key is not new: %q, %v", name, key, err)
+		}
+	}
+}
+
+func TestWriteCertificateFiles(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	domain := &Domain{Tenant: "team-a", Domain: "example.com"}
+	ocspFile := filepath.Join("certs", "team-a", "example.com.cert.ocsp")
+	for _, cert := range []string{"first cert", "second cert"} {
+		// haproxy loads the ocsp response beside the certificate
+		if err := os.MkdirAll(filepath.Dir(ocspFile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(ocspFile, []byte("previous response"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCertificateFiles(domain, []byte(cert), key); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join("certs", "team-a", "example.com.cert"))
+		if err != nil || string(data) != cert {
+			t.Errorf("stable certificate = %q, %v, want %q", data, err, cert)
+		}
+		if _, err := os.Stat(ocspFile); !os.IsNotExist(err) {
+			t.Error("ocsp response of the previous certificate is kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	copies, _ := filepath.Glob(filepath.Join("certs", "team-a", "example.com_*.cert"))
+	keys, _ := filepath.Glob(filepath.Join("certs", "team-a", "example.com_*.key"))
+	if len(copies) != 2 || len(keys) != 2 {
+		t.Errorf("timestamped files: %v %v", copies, keys)
+	}
+
+	// the key of a submitted csr is not written
+	other := &Domain{Domain: "example.org"}
+	if err := writeCertificateFiles(other, []byte("cert"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := filepath.Glob(filepath.Join("certs", "example.org_*.key")); len(keys) != 0 {
+		t.Errorf("key files of csr: %v", keys)
+	}
+}
+
+func TestProcessDomainPropagationCheck(t *testing.T) {
+	openTestDb(t)
+	retryTime := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+	domain := challengingDomain(t, "www.example.invalid", Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       "www.example.invalid",
+		KeyAuthorization: "token.thumbprint",
+	})
+	domain.ChallengeTime = time.Now().Format(time.RFC3339Nano)
+	domain.NextAttemptTime = retryTime
+	if err := UpdateDomainDirect(domain.key(), domain); err != nil {
+		t.Fatal(err)
+	}
+
+	processDomain(context.Background(), domain.key())
+	saved, err := QueryDomain(domain.key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != IssueChallenging || saved.NextAttemptTime != retryTime {
+		t.Errorf("status %s, next attempt %q, want retry time %q kept", saved.Status, saved.NextAttemptTime, retryTime)
+	}
+	if next, _ := nextActionTime(saved); next.Before(time.Now().Add(propagationCheckInterval / 2)) {
+		t.Errorf("next propagation check = %v", next)
+	}
+}
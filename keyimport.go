@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+)
+
+// jwk is the json web key format used by certbot's private_key.json
+type jwk struct {
+	Kty string `json:"kty"`
+
+	// RSA
+	N  string `json:"n"`
+	E  string `json:"e"`
+	D  string `json:"d"`
+	P  string `json:"p"`
+	Q  string `json:"q"`
+	Dp string `json:"dp"`
+	Dq string `json:"dq"`
+	Qi string `json:"qi"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseAccountKey parses an existing account private key in PEM or JWK format
+func ParseAccountKey(data []byte) (crypto.Signer, error) {
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) == 0 {
+		return nil, errors.New("empty key data")
+	}
+	if data[0] == '{' {
+		return parseJWKPrivateKey(data)
+	}
+	return parsePemPrivateKey(data)
+}
+
+func parsePemPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		return signer, nil
+	default:
+		return nil, errors.New("unsupported pem block type: " + block.Type)
+	}
+}
+
+func parseJWKPrivateKey(data []byte) (crypto.Signer, error) {
+	k := new(jwk)
+	err := json.Unmarshal(data, k)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := jwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		d, err := jwkInt(k.D)
+		if err != nil {
+			return nil, err
+		}
+		p, err := jwkInt(k.P)
+		if err != nil {
+			return nil, err
+		}
+		q, err := jwkInt(k.Q)
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		err = key.Validate()
+		if err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported jwk curve: " + k.Crv)
+		}
+		x, err := jwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		d, err := jwkInt(k.D)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("jwk point is not on curve")
+		}
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         d,
+		}, nil
+	default:
+		return nil, errors.New("unsupported jwk key type: " + k.Kty)
+	}
+}
+
+func jwkInt(v string) (*big.Int, error) {
+	if len(v) == 0 {
+		return nil, errors.New("jwk field missing")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// ReadCertbotAccountKey reads the private key of a certbot account directory,
+// e.g. /etc/letsencrypt/accounts/acme-v02.api.letsencrypt.org/directory/<id>
+func ReadCertbotAccountKey(dir string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(dir, "private_key.json"))
+}
+
+// encodePrivateKey keeps the EC format of generated keys and uses PKCS#8 for other key types
+func encodePrivateKey(key crypto.Signer) (string, error) {
+	var data []byte
+	var err error
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		data, err = x509.MarshalECPrivateKey(ecKey)
+	} else {
+		data, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func decodePrivateKey(keyString string) (crypto.Signer, error) {
+	data, err := base64.StdEncoding.DecodeString(keyString)
+	if err != nil {
+		return nil, err
+	}
+	if ecKey, err := x509.ParseECPrivateKey(data); err == nil {
+		return ecKey, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
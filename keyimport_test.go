@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+type publicKeyEqual interface {
+	Equal(crypto.PublicKey) bool
+}
+
+func jwkEncodeInt(v *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(v.Bytes())
+}
+
+func ecJwk(key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"crv": key.Curve.Params().Name,
+		"x":   jwkEncodeInt(key.X),
+		"y":   jwkEncodeInt(key.Y),
+		"d":   jwkEncodeInt(key.D),
+	}
+}
+
+func rsaJwk(key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"n":   jwkEncodeInt(key.N),
+		"e":   jwkEncodeInt(big.NewInt(int64(key.E))),
+		"d":   jwkEncodeInt(key.D),
+		"p":   jwkEncodeInt(key.Primes[0]),
+		"q":   jwkEncodeInt(key.Primes[1]),
+	}
+}
+
+func jwkData(fields map[string]string, changes ...string) []byte {
+	k := make(map[string]string)
+	for name, v := range fields {
+		k[name] = v
+	}
+	// changes are pairs of field and value, an empty value removes the field
+	for i := 0; i+1 < len(changes); i += 2 {
+		if len(changes[i+1]) == 0 {
+			delete(k, changes[i])
+		} else {
+			k[changes[i]] = changes[i+1]
+		}
+	}
+	data, _ := json.Marshal(k)
+	return data
+}
+
+func pemData(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestParseAccountKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	rsaPkcs8, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	edPkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	valid := map[string]struct {
+		data []byte
+		key  crypto.PublicKey
+	}{
+		"pem ec":            {pemData("EC PRIVATE KEY", ecDer), &ecKey.PublicKey},
+		"pem rsa pkcs1":     {pemData("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), &rsaKey.PublicKey},
+		"pem ec pkcs8":      {pemData("PRIVATE KEY", ecPkcs8), &ecKey.PublicKey},
+		"pem rsa pkcs8":     {pemData("PRIVATE KEY", rsaPkcs8), &rsaKey.PublicKey},
+		"pem ed25519 pkcs8": {pemData("PRIVATE KEY", edPkcs8), edKey.Public()},
+		"pem with spaces":   {append([]byte("\n  "), pemData("EC PRIVATE KEY", ecDer)...), &ecKey.PublicKey},
+		"jwk ec p-256":      {jwkData(ecJwk(ecKey)), &ecKey.PublicKey},
+		"jwk ec p-384":      {jwkData(ecJwk(ec384Key)), &ec384Key.PublicKey},
+		"jwk rsa":           {jwkData(rsaJwk(rsaKey)), &rsaKey.PublicKey},
+		// older certbot versions pad the base64 fields
+		"jwk rsa padded": {jwkData(rsaJwk(rsaKey), "e", base64.URLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())), &rsaKey.PublicKey},
+	}
+	for name, v := range valid {
+		t.Run(name, func(t *testing.T) {
+			key, err := ParseAccountKey(v.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Public().(publicKeyEqual).Equal(v.key) {
+				t.Error("parsed key does not match")
+			}
+		})
+	}
+
+	invalid := map[string][]byte{
+		"empty":                   []byte(" \n"),
+		"not pem":                 []byte("private key"),
+		"pem of certificate":      pemData("CERTIFICATE", []byte{1, 2, 3}),
+		"pem of broken ec key":    pemData("EC PRIVATE KEY", []byte{1, 2, 3}),
+		"pem of rsa as ec key":    pemData("EC PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"broken json":             []byte(`{"kty":`),
+		"jwk unknown type":        []byte(`{"kty":"oct","k":"AAAA"}`),
+		"jwk unknown curve":       jwkData(ecJwk(ecKey), "crv", "P-192"),
+		"jwk point off curve":     jwkData(ecJwk(ecKey), "y", jwkEncodeInt(new(big.Int).Add(ecKey.Y, big.NewInt(1)))),
+		"jwk ec missing d":        jwkData(ecJwk(ecKey), "d", ""),
+		"jwk rsa wrong prime":     jwkData(rsaJwk(rsaKey), "q", jwkEncodeInt(big.NewInt(7))),
+		"jwk rsa missing d":       jwkData(rsaJwk(rsaKey), "d", ""),
+		"jwk illegal base64 of x": jwkData(ecJwk(ecKey), "x", "!!"),
+	}
+	for name, data := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseAccountKey(data)
+			if err == nil {
+				t.Error("parse succeeded")
+			}
+		})
+	}
+}
+
+func TestReadCertbotAccountKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "private_key.json"), jwkData(ecJwk(ecKey)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadCertbotAccountKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseAccountKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Public().(publicKeyEqual).Equal(&ecKey.PublicKey) {
+		t.Error("key of certbot account does not match")
+	}
+
+	_, err = ReadCertbotAccountKey(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("read of missing account succeeded")
+	}
+}
+
+func TestEncodeDecodePrivateKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		encoded, err := encodePrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodePrivateKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Public().(publicKeyEqual).Equal(key.Public()) {
+			t.Errorf("decoded %T does not match", key)
+		}
+	}
+
+	_, err = decodePrivateKey("not base64!")
+	if err == nil {
+		t.Error("decode of illegal key succeeded")
+	}
+}
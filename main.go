@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -12,16 +16,40 @@ import (
 	"github.com/dgraph-io/badger"
 )
 
-var client *AcmeClient
+var clients = make(map[string]*AcmeClient)
 var db *badger.DB
 
+// caClient returns the client of the CA profile, empty name for the default
+func caClient(caName string) (*AcmeClient, error) {
+	profile := config.caProfile(caName)
+	if profile == nil {
+		return nil, errors.New("unknown ca profile: " + caName)
+	}
+	return clients[profile.Name], nil
+}
+
 func main() {
 
-	//TODO production
-	client = newAcmeClient(false)
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	configFile := flag.String("config", "config.json", "config file")
+	flag.Parse()
+
+	loadedConfig, err := loadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	config = loadedConfig
+	// interrupts acme requests on shutdown
+	acmeCtx, abortAcme := context.WithCancel(context.Background())
+	for _, v := range config.CaProfiles {
+		clients[v.Name] = newAcmeClient(acmeCtx, v.DirectoryUrl)
+	}
 
 	// certificate output
-	err := os.MkdirAll(strings.Join([]string{".", "certs"}, string(os.PathSeparator)), os.FileMode(0755))
+	err = os.MkdirAll(strings.Join([]string{".", "certs"}, string(os.PathSeparator)), os.FileMode(0755))
 	if err != nil {
 		panic(err)
 	}
@@ -65,14 +93,69 @@ func main() {
 		dbOpenLock.Unlock()
 	}()
 
+	err = loadChallengeIndex()
+	if err != nil {
+		panic(err)
+	}
+
 	//TODO need configure listening address
-	go startHttp(":8085")
-	go StartJob()
+	server, err := newHttpServer(":8085")
+	if err != nil {
+		panic(err)
+	}
+	go startHttp(server)
+	var challengeServers []*http.Server
+	if len(config.Http01Address) > 0 {
+		http01Server := newHttp01Server(config.Http01Address)
+		go startHttp(http01Server)
+		challengeServers = append(challengeServers, http01Server)
+	}
+	if len(config.TlsAlpn01Address) > 0 {
+		tlsAlpn01Server := newTlsAlpn01Server(config.TlsAlpn01Address)
+		go startHttp(tlsAlpn01Server)
+		challengeServers = append(challengeServers, tlsAlpn01Server)
+	}
+
+	jobCtx, stopJob := context.WithCancel(context.Background())
+	jobDone := make(chan struct{})
+	go func() {
+		StartJob(jobCtx, acmeCtx)
+		close(jobDone)
+	}()
 
 	fmt.Println("server started.")
 
 	// waiting for exit signal
 	waitSignal()
+
+	shutdown(append(challengeServers, server), stopJob, abortAcme, jobDone)
+}
+
+// wait for in-flight acme operations before interrupting them
+var shutdownDrainTimeout = 60 * time.Second
+
+func shutdown(servers []*http.Server, stopJob, abortAcme context.CancelFunc, jobDone chan struct{}) {
+	fmt.Println("shutting down...")
+	stopJob()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "http server shutdown error:", err)
+		}
+	}
+
+	select {
+	case <-jobDone:
+	case <-ctx.Done():
+		fmt.Println("drain timeout, interrupting acme operations...")
+		abortAcme()
+		// interrupted requests return at once, the database is closed after the jobs
+		<-jobDone
+	}
+	abortAcme()
 }
 
 func waitSignal() {
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// normalizeName returns the canonical form of a dns name or ip address of a certificate
+func normalizeName(name string) (string, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String(), nil
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if len(name) == 0 || len(name) > 253 {
+		return "", errors.New("illegal name length: " + name)
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", errors.New("name is not fully qualified: " + name)
+	}
+	// top level domains are never numeric, such names are malformed ip addresses
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", errors.New("illegal ip address: " + name)
+	}
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if len(label) == 0 || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", errors.New("illegal label of name: " + name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", errors.New("illegal character of name: " + name)
+			}
+		}
+	}
+	return name, nil
+}
+
+// validateIssueNames normalizes the names and checks they can be validated by the challenge type.
+// dns-01 is not allowed for ip addresses, wildcards need dns-01.
+func validateIssueNames(names []string, challengeType string) ([]string, error) {
+	if _, ok := acmeChallengeTypes[challengeType]; !ok {
+		return nil, errors.New("unknown challenge type: " + challengeType)
+	}
+
+	result := make([]string, 0, len(names))
+	found := make(map[string]bool)
+	for _, v := range names {
+		name, err := normalizeName(v)
+		if err != nil {
+			return nil, err
+		}
+		if found[name] {
+			return nil, errors.New("duplicate name: " + name)
+		}
+		found[name] = true
+
+		if identifierType(name) == IdentifierIp && challengeType == "dns" {
+			return nil, errors.New("dns challenge is not allowed for ip address: " + name)
+		}
+		if strings.HasPrefix(name, "*.") && challengeType != "dns" {
+			return nil, errors.New("wildcard needs dns challenge: " + name)
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
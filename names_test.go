@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"WWW.Example.COM.", "www.example.com", true},
+		{"*.example.com", "*.example.com", true},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", true},
+		{"a-b.example.com", "a-b.example.com", true},
+		{"192.0.2.1", "192.0.2.1", true},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"2001:db8:0:0:0:0:0:1", "2001:db8::1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+
+		{"", "", false},
+		{".", "", false},
+		{"localhost", "", false},
+		{"*", "", false},
+		{"www.*.example.com", "", false},
+		{"**.example.com", "", false},
+		{"-www.example.com", "", false},
+		{"www-.example.com", "", false},
+		{"www..example.com", "", false},
+		{"www_1.example.com", "", false},
+		{"bücher.example", "", false},
+		{strings.Repeat("a", 64) + ".example.com", "", false},
+		{strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", "", false},
+		{"[2001:db8::1]", "", false},
+		// numeric top level domains are malformed ip addresses
+		{"192.0.2.256", "", false},
+		{"10.1", "", false},
+		{"www.example.123", "", false},
+	}
+	for _, c := range cases {
+		got, err := normalizeName(c.name)
+		if (err == nil) != c.ok {
+			t.Errorf("normalizeName(%q) error = %v, want ok %v", c.name, err, c.ok)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidateIssueNames(t *testing.T) {
+	cases := []struct {
+		desc      string
+		names     []string
+		challenge string
+		want      []string
+	}{
+		{"dns names", []string{"Example.com", "www.example.com."}, "http", []string{"example.com", "www.example.com"}},
+		{"wildcard with dns", []string{"example.com", "*.example.com"}, "dns", []string{"example.com", "*.example.com"}},
+		{"wildcard with http", []string{"*.example.com"}, "http", nil},
+		{"wildcard with tls-alpn", []string{"*.example.com"}, "tls-alpn", nil},
+		{"ip with http", []string{"192.0.2.1", "2001:DB8::1"}, "http", []string{"192.0.2.1", "2001:db8::1"}},
+		{"ip with tls-alpn", []string{"192.0.2.1"}, "tls-alpn", []string{"192.0.2.1"}},
+		{"ip with dns", []string{"example.com", "192.0.2.1"}, "dns", nil},
+		{"ip and dns name", []string{"example.com", "192.0.2.1"}, "http", []string{"example.com", "192.0.2.1"}},
+		{"duplicate name", []string{"example.com", "EXAMPLE.com."}, "http", nil},
+		{"duplicate ip", []string{"2001:db8::1", "2001:db8:0::1"}, "http", nil},
+		{"illegal name", []string{"example.com", "bad_name.example.com"}, "http", nil},
+		{"unknown challenge", []string{"example.com"}, "dns-01", nil},
+	}
+	for _, c := range cases {
+		got, err := validateIssueNames(c.names, c.challenge)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%s: validateIssueNames = %v, want error", c.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: validateIssueNames error: %v", c.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: validateIssueNames = %v, want %v", c.desc, got, c.want)
+		}
+	}
+}
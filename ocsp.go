@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	OcspGood    = "good"
+	OcspRevoked = "revoked"
+	OcspUnknown = "unknown"
+)
+
+var (
+	// retry interval of failed ocsp fetching
+	ocspRetryInterval = time.Hour
+	// refresh interval when the responder gives no next update
+	ocspDefaultRefresh = 12 * time.Hour
+	ocspFetchTimeout   = 30 * time.Second
+)
+
+// certificates without ocsp responder, e.g. of CAs which dropped ocsp, are not stapled
+var errNoOcspResponder = errors.New("no ocsp responder of certificate")
+
+// OcspResponse is the cached ocsp response of the current certificate of a domain
+type OcspResponse struct {
+	Tenant       string
+	Domain       string
+	SerialNumber string
+	Status       string
+	FetchTime    string
+	ThisUpdate   string
+	NextUpdate   string
+	RevokedAt    string
+	// base64 of the der response
+	ResponseData string
+}
+
+// refreshTime is half way of the validity of the response
+func (this *OcspResponse) refreshTime() time.Time {
+	thisUpdate, err1 := time.Parse(time.RFC3339Nano, this.ThisUpdate)
+	nextUpdate, err2 := time.Parse(time.RFC3339Nano, this.NextUpdate)
+	if err1 != nil || err2 != nil || !nextUpdate.After(thisUpdate) {
+		fetchTime, err := time.Parse(time.RFC3339Nano, this.FetchTime)
+		if err != nil {
+			return time.Now()
+		}
+		return fetchTime.Add(ocspDefaultRefresh)
+	}
+	return thisUpdate.Add(nextUpdate.Sub(thisUpdate) / 2)
+}
+
+// OcspFilePath is beside the certificate file, where haproxy looks for the response of <crt>
+func OcspFilePath(domain *Domain) (string, error) {
+	return outputPath(domain, ".cert.ocsp")
+}
+
+// ocspDue checks whether the ocsp response of an available domain should be refreshed
+func ocspDue(domain *Domain, now time.Time) bool {
+	if len(domain.OcspRefreshTime) == 0 {
+		return true
+	}
+	refreshTime, err := time.Parse(time.RFC3339Nano, domain.OcspRefreshTime)
+	if err != nil {
+		return true
+	}
+	return !now.Before(refreshTime)
+}
+
+// certificateIssuer returns the leaf certificate and its issuer from the certificate record
+func certificateIssuer(cert *Certificate) (*x509.Certificate, *x509.Certificate, error) {
+	var certs []*x509.Certificate
+	data := []byte(cert.CertificatePem)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) < 2 {
+		return nil, nil, errors.New("issuer certificate not found: " + cert.Domain)
+	}
+	return certs[0], certs[1], nil
+}
+
+// fetchOcspResponse requests the status of the certificate from the responder of the issuer
+func fetchOcspResponse(ctx context.Context, cert *Certificate) (*OcspResponse, []byte, error) {
+	leaf, issuer, err := certificateIssuer(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errNoOcspResponder
+	}
+	reqData, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ocspFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqData))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("ocsp responder status: " + resp.Status)
+	}
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(respData, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &OcspResponse{
+		Tenant:       cert.Tenant,
+		Domain:       cert.Domain,
+		SerialNumber: cert.SerialNumber,
+		FetchTime:    time.Now().Format(time.RFC3339Nano),
+		ThisUpdate:   parsed.ThisUpdate.Format(time.RFC3339Nano),
+		ResponseData: base64.StdEncoding.EncodeToString(respData),
+	}
+	if !parsed.NextUpdate.IsZero() {
+		result.NextUpdate = parsed.NextUpdate.Format(time.RFC3339Nano)
+	}
+	switch parsed.Status {
+	case ocsp.Good:
+		result.Status = OcspGood
+	case ocsp.Revoked:
+		result.Status = OcspRevoked
+		result.RevokedAt = parsed.RevokedAt.Format(time.RFC3339Nano)
+	default:
+		result.Status = OcspUnknown
+	}
+	return result, respData, nil
+}
+
+// refreshOcsp fetches, caches and writes the ocsp response of the current certificate of the domain.
+// The refresh time of the domain is updated, revoked certificates are reported as revoked.
+func refreshOcsp(ctx context.Context, domain *Domain) (revoked bool, err error) {
+	cert, err := QueryCertificate(domain.key())
+	if err == badger.ErrKeyNotFound {
+		// no certificate to staple
+		domain.OcspRefreshTime = domain.ExpireTime
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	result, respData, err := fetchOcspResponse(ctx, cert)
+	if err == errNoOcspResponder {
+		// the certificate never gets a responder, check again with the next certificate
+		domain.OcspRefreshTime = domain.ExpireTime
+		return false, nil
+	}
+	if err != nil {
+		domain.OcspRefreshTime = time.Now().Add(ocspRetryInterval).Format(time.RFC3339Nano)
+		return false, err
+	}
+	err = SaveOcspResponse(domain.key(), result)
+	if err != nil {
+		domain.OcspRefreshTime = time.Now().Add(ocspRetryInterval).Format(time.RFC3339Nano)
+		return false, err
+	}
+	domain.OcspRefreshTime = result.refreshTime().Format(time.RFC3339Nano)
+
+	ocspFile, err := OcspFilePath(domain)
+	if err != nil {
+		logline("ocsp file path error:", domain.Domain, err)
+		return result.Status == OcspRevoked, nil
+	}
+	if result.Status == OcspRevoked {
+		_ = os.Remove(ocspFile)
+		return true, nil
+	}
+	if result.Status == OcspGood {
+		err = ioutil.WriteFile(ocspFile, respData, 0644)
+		if err != nil {
+			logline("write ocsp file error:", domain.Domain, err)
+		}
+	}
+	return false, nil
+}
+
+func SaveOcspResponse(domain string, resp *OcspResponse) error {
+	data, _ := json.Marshal(resp)
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(OcspTable(domain), data)
+	})
+}
+
+func QueryAllOcspResponses() ([]*OcspResponse, error) {
+	var result []*OcspResponse
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(OcspTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			resp := new(OcspResponse)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, resp)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, resp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOcspRefreshTime(t *testing.T) {
+	fetch := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	format := func(v time.Time) string {
+		return v.Format(time.RFC3339Nano)
+	}
+
+	resp := &OcspResponse{FetchTime: format(fetch), ThisUpdate: format(fetch), NextUpdate: format(fetch.Add(7 * 24 * time.Hour))}
+	if got, want := resp.refreshTime(), fetch.Add(84*time.Hour); !got.Equal(want) {
+		t.Errorf("refresh time = %v, want half validity %v", got, want)
+	}
+
+	// responders without next update are refreshed after the default interval
+	resp.NextUpdate = ""
+	if got, want := resp.refreshTime(), fetch.Add(ocspDefaultRefresh); !got.Equal(want) {
+		t.Errorf("refresh time without next update = %v, want %v", got, want)
+	}
+	resp.NextUpdate = format(fetch.Add(-time.Hour))
+	if got, want := resp.refreshTime(), fetch.Add(ocspDefaultRefresh); !got.Equal(want) {
+		t.Errorf("refresh time of next update in the past = %v, want %v", got, want)
+	}
+}
+
+func TestOcspDue(t *testing.T) {
+	now := time.Now()
+	if !ocspDue(&Domain{}, now) {
+		t.Error("never fetched response is not due")
+	}
+	if !ocspDue(&Domain{OcspRefreshTime: "soon"}, now) {
+		t.Error("response of illegal refresh time is not due")
+	}
+	if !ocspDue(&Domain{OcspRefreshTime: now.Format(time.RFC3339Nano)}, now) {
+		t.Error("response is not due at refresh time")
+	}
+	if ocspDue(&Domain{OcspRefreshTime: now.Add(time.Minute).Format(time.RFC3339Nano)}, now) {
+		t.Error("response is due before refresh time")
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openapi.json describes all endpoints and is kept in sync with the handlers
+//
+//go:embed openapi.json
+var openApiDocument []byte
+
+func httpOpenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(openApiDocument)
+}
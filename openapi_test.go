@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOpenApiDocumentsRoutes(t *testing.T) {
+	var document struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(openApiDocument, &document); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range apiV2Routes {
+		// wildcards are documented as path parameters
+		var segments []string
+		for _, v := range strings.Split(route.Pattern, "/") {
+			if v == "*" {
+				v = "{"
+			}
+			segments = append(segments, v)
+		}
+		found := false
+		for path, operations := range document.Paths {
+			if !strings.HasPrefix(path, ApiV2Prefix) {
+				continue
+			}
+			documented := strings.Split(strings.TrimPrefix(path, ApiV2Prefix), "/")
+			if len(documented) != len(segments) {
+				continue
+			}
+			matched := true
+			for i, v := range segments {
+				if v != documented[i] && !(v == "{" && strings.HasPrefix(documented[i], "{")) {
+					matched = false
+				}
+			}
+			if _, ok := operations[strings.ToLower(route.Method)]; matched && ok {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s %s is not documented", route.Method, route.Pattern)
+		}
+	}
+}
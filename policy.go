@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Policy restricts the names an account may request certificates for
+type Policy struct {
+	// names must be equal to or under one of the zones, or match one of the patterns.
+	// No restriction when both are empty.
+	AllowedZones    []string
+	AllowedPatterns []string
+	// names equal to or under denied names are never allowed
+	DeniedNames []string
+	// max names of a certificate, 0 for no limit
+	MaxNames      int
+	AllowWildcard bool
+
+	allowedPatterns []*regexp.Regexp
+}
+
+func (this *Policy) compile() error {
+	this.allowedPatterns = nil
+	for _, v := range this.AllowedPatterns {
+		// patterns match the whole name
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return err
+		}
+		this.allowedPatterns = append(this.allowedPatterns, re)
+	}
+	return nil
+}
+
+// check returns the reason why the names of a certificate are not allowed
+func (this *Policy) check(names []string) error {
+	if this.MaxNames > 0 && len(names) > this.MaxNames {
+		return errors.New("too many names, max " + strconv.Itoa(this.MaxNames))
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") && !this.AllowWildcard {
+			return errors.New("wildcard is not allowed: " + name)
+		}
+		for _, v := range this.DeniedNames {
+			if inZone(name, v) {
+				return errors.New("name is denied: " + name)
+			}
+		}
+		if !this.allowed(name) {
+			return errors.New("name is not allowed: " + name)
+		}
+	}
+	return nil
+}
+
+func (this *Policy) allowed(name string) bool {
+	if len(this.AllowedZones) == 0 && len(this.allowedPatterns) == 0 {
+		return true
+	}
+	for _, v := range this.AllowedZones {
+		if inZone(name, v) {
+			return true
+		}
+	}
+	for _, v := range this.allowedPatterns {
+		if v.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inZone checks whether the name, wildcard or not, is the zone or under the zone
+func inZone(name string, zone string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// checkPolicy evaluates the policies of all accounts of the tenant which may request the names
+func checkPolicy(tenant string, accountList []string, names []string) error {
+	for _, mail := range accountList {
+		policy := config.policy(tenantKey(tenant, mail))
+		if policy == nil {
+			continue
+		}
+		err := policy.check(names)
+		if err != nil {
+			return errors.New("policy of " + mail + ": " + err.Error())
+		}
+	}
+	return nil
+}
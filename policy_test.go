@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestInZone(t *testing.T) {
+	cases := []struct {
+		name string
+		zone string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"a.b.example.com", "example.com", true},
+		{"*.example.com", "example.com", true},
+		{"*.www.example.com", "example.com", true},
+		{"www.example.com", "Example.COM.", true},
+		{"badexample.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+		{"example.org", "example.com", false},
+	}
+	for _, c := range cases {
+		if got := inZone(c.name, c.zone); got != c.want {
+			t.Errorf("inZone(%q, %q) = %v, want %v", c.name, c.zone, got, c.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := map[string]struct {
+		policy  Policy
+		names   []string
+		allowed bool
+	}{
+		"no restriction":             {Policy{}, []string{"example.com", "www.example.org"}, true},
+		"zone":                       {Policy{AllowedZones: []string{"example.com"}}, []string{"example.com", "www.example.com"}, true},
+		"outside zone":               {Policy{AllowedZones: []string{"example.com"}}, []string{"www.example.com", "example.org"}, false},
+		"zone suffix only":           {Policy{AllowedZones: []string{"example.com"}}, []string{"badexample.com"}, false},
+		"pattern":                    {Policy{AllowedPatterns: []string{`[a-z]+\.svc\.local`}}, []string{"api.svc.local"}, true},
+		"pattern matches whole name": {Policy{AllowedPatterns: []string{`[a-z]+\.svc\.local`}}, []string{"api.svc.local.example.com"}, false},
+		"zone or pattern":            {Policy{AllowedZones: []string{"example.com"}, AllowedPatterns: []string{`api\.example\.org`}}, []string{"example.com", "api.example.org"}, true},
+		"denied name":                {Policy{DeniedNames: []string{"admin.example.com"}}, []string{"admin.example.com"}, false},
+		"under denied name":          {Policy{AllowedZones: []string{"example.com"}, DeniedNames: []string{"admin.example.com"}}, []string{"x.admin.example.com"}, false},
+		"beside denied name":         {Policy{AllowedZones: []string{"example.com"}, DeniedNames: []string{"admin.example.com"}}, []string{"www.example.com"}, true},
+		"max names":                  {Policy{MaxNames: 2}, []string{"a.example.com", "b.example.com"}, true},
+		"too many names":             {Policy{MaxNames: 2}, []string{"a.example.com", "b.example.com", "c.example.com"}, false},
+		"wildcard not allowed":       {Policy{}, []string{"*.example.com"}, false},
+		"wildcard allowed":           {Policy{AllowWildcard: true, AllowedZones: []string{"example.com"}}, []string{"*.example.com"}, true},
+		"wildcard under denied name": {Policy{AllowWildcard: true, DeniedNames: []string{"example.com"}}, []string{"*.example.com"}, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			policy := test.policy
+			err := policy.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = policy.check(test.names)
+			if (err == nil) != test.allowed {
+				t.Errorf("check(%v) = %v, want allowed %v", test.names, err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestPolicyCompileError(t *testing.T) {
+	policy := Policy{AllowedPatterns: []string{"("}}
+	if policy.compile() == nil {
+		t.Error("compile of illegal pattern succeeded")
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	useTestConfig(t, &Config{
+		DefaultPolicy: &Policy{AllowedZones: []string{"example.com"}},
+		AccountPolicies: map[string]*Policy{
+			"open@example.com":        {},
+			"team-a/team@example.com": {AllowedZones: []string{"example.org"}},
+		},
+	})
+
+	err := checkPolicy("", []string{"x@example.com"}, []string{"www.example.com"})
+	if err != nil {
+		t.Errorf("default policy denies name in zone: %v", err)
+	}
+	err = checkPolicy("", []string{"x@example.com"}, []string{"www.example.org"})
+	if err == nil {
+		t.Error("default policy allows name out of zone")
+	}
+	err = checkPolicy("", []string{"open@example.com"}, []string{"www.example.org"})
+	if err != nil {
+		t.Errorf("account policy is not used: %v", err)
+	}
+	// every account of the domain may order the certificate
+	err = checkPolicy("", []string{"open@example.com", "x@example.com"}, []string{"www.example.org"})
+	if err == nil {
+		t.Error("policy of the fallback account is not checked")
+	}
+
+	// policies of accounts of tenants are keyed by tenant and mail
+	err = checkPolicy("team-a", []string{"team@example.com"}, []string{"www.example.org"})
+	if err != nil {
+		t.Errorf("policy of tenant account is not used: %v", err)
+	}
+	err = checkPolicy("", []string{"team@example.com"}, []string{"www.example.org"})
+	if err == nil {
+		t.Error("policy of tenant account is used for the default tenant")
+	}
+	err = checkPolicy("team-b", []string{"open@example.com"}, []string{"www.example.org"})
+	if err == nil {
+		t.Error("policy of default tenant account is used for other tenants")
+	}
+
+	// no restriction without policies
+	useTestConfig(t, &Config{})
+	err = checkPolicy("", []string{"x@example.com"}, []string{"www.example.org"})
+	if err != nil {
+		t.Errorf("names are restricted without policies: %v", err)
+	}
+}
+
+func TestLoadConfigPolicies(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "config.json")
+	_ = ioutil.WriteFile(f, []byte(`{"AccountPolicies": {"a@example.com": {"AllowedPatterns": ["api[0-9]+\\.example\\.com"]}}}`), 0600)
+	c, err := loadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.policy("a@example.com").check([]string{"api1.example.com"}); err != nil {
+		t.Errorf("pattern of loaded policy is not compiled: %v", err)
+	}
+	if c.policy("b@example.com") != nil {
+		t.Error("account without policy is restricted")
+	}
+
+	for _, data := range []string{
+		`{"DefaultPolicy": {"AllowedPatterns": ["("]}}`,
+		`{"AccountPolicies": {"a@example.com": {"AllowedPatterns": ["("]}}}`,
+		`{"AccountPolicies": {"a@example.com": null}}`,
+	} {
+		_ = ioutil.WriteFile(f, []byte(data), 0600)
+		_, err := loadConfig(f)
+		if err == nil {
+			t.Errorf("illegal policy is loaded: %s", data)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eggsampler/acme"
+)
+
+var (
+	// recheck interval of dns records not yet propagated
+	propagationCheckInterval = 30 * time.Second
+	// validate anyway when records are still not visible after this duration
+	propagationTimeout = time.Hour
+)
+
+// challengePropagated checks whether the dns-01 records of all challenges are visible
+func challengePropagated(ctx context.Context, domain *Domain) bool {
+	if len(domain.ChallengeTime) > 0 {
+		challengeTime, err := time.Parse(time.RFC3339Nano, domain.ChallengeTime)
+		if err == nil && time.Since(challengeTime) > propagationTimeout {
+			logline("[job] dns propagation timeout, validate anyway:", domain.Domain)
+			return true
+		}
+	}
+
+	chals, err := domain.challenges()
+	if err != nil {
+		logline("unmarshal challenges error:", domain.Domain, err)
+		return true
+	}
+	for _, chal := range chals {
+		// challenges saved before identifiers were recorded can not be checked
+		if chal.Type != acme.ChallengeTypeDNS01 || len(chal.Identifier) == 0 {
+			continue
+		}
+		recordName := "_acme-challenge." + strings.TrimPrefix(chal.Identifier, "*.")
+		if !txtRecordExists(ctx, recordName, acme.EncodeDNS01KeyAuthorization(chal.KeyAuthorization)) {
+			logline("[job] dns record not propagated:", recordName)
+			return false
+		}
+	}
+	return true
+}
+
+func txtRecordExists(ctx context.Context, name string, value string) bool {
+	records, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, v := range records {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"golang.org/x/net/publicsuffix"
+)
+
+// rateLimit is a limit of the CA counted locally in a sliding window.
+// The defaults are the limits of Let's Encrypt, CA profiles may override them.
+type rateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+var (
+	certificatesPerDomainLimit = &rateLimit{Name: "certificates_per_domain", Limit: 50, Window: 7 * 24 * time.Hour}
+	duplicateCertificateLimit  = &rateLimit{Name: "duplicate_certificate", Limit: 5, Window: 7 * 24 * time.Hour}
+	failedValidationLimit      = &rateLimit{Name: "failed_validation", Limit: 5, Window: time.Hour}
+	newOrdersLimit             = &rateLimit{Name: "new_orders", Limit: 300, Window: 3 * time.Hour}
+)
+
+var defaultRateLimits = map[string]*rateLimit{
+	certificatesPerDomainLimit.Name: certificatesPerDomainLimit,
+	duplicateCertificateLimit.Name:  duplicateCertificateLimit,
+	failedValidationLimit.Name:      failedValidationLimit,
+	newOrdersLimit.Name:             newOrdersLimit,
+}
+
+// RateLimitConfig overrides a default limit in a CA profile
+type RateLimitConfig struct {
+	// events allowed within the window, 0 for no limit
+	Limit int
+	// length of the sliding window, e.g. "168h"
+	Window string
+}
+
+// validateRateLimits checks the overridden limits of the profile
+func (this *CaProfile) validateRateLimits() error {
+	for name, v := range this.RateLimits {
+		if _, ok := defaultRateLimits[name]; !ok {
+			return errors.New("unknown rate limit of ca profile " + this.Name + ": " + name)
+		}
+		if v == nil || v.Limit < 0 {
+			return errors.New("illegal rate limit of ca profile " + this.Name + ": " + name)
+		}
+		if v.Limit == 0 {
+			continue
+		}
+		window, err := time.ParseDuration(v.Window)
+		if err != nil || window <= 0 {
+			return errors.New("illegal rate limit window of ca profile " + this.Name + ": " + name)
+		}
+	}
+	return nil
+}
+
+// rateLimit returns the limit counted for the CA of the profile
+func (this *CaProfile) rateLimit(limit *rateLimit) *rateLimit {
+	if this == nil {
+		return limit
+	}
+	v, ok := this.RateLimits[limit.Name]
+	if !ok || v == nil {
+		return limit
+	}
+	if v.Limit == 0 {
+		return &rateLimit{Name: limit.Name}
+	}
+	window, err := time.ParseDuration(v.Window)
+	if err != nil {
+		// validated when loading the config
+		return limit
+	}
+	return &rateLimit{Name: limit.Name, Limit: v.Limit, Window: window}
+}
+
+// wait this long after a rateLimited problem without Retry-After header
+var rateLimitedDelay = time.Hour
+
+const rateLimitedProblemType = "urn:ietf:params:acme:error:rateLimited"
+
+// update attempts of a rate limit record modified concurrently
+var rateLimitUpdateAttempts = 5
+
+// RateLimitRecord holds the event times of a limit and key within the window
+type RateLimitRecord struct {
+	Limit  string
+	Key    string
+	Events []string
+	// window of the limit when the last event was recorded
+	Window string
+}
+
+func (this *rateLimit) prune(record *RateLimitRecord, now time.Time) {
+	var events []string
+	for _, v := range record.Events {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err == nil && now.Sub(t) < this.Window {
+			events = append(events, v)
+		}
+	}
+	record.Events = events
+}
+
+// recordEvent counts an event of the limit, errors are only logged.
+// Events of a key recorded at the same time conflict, the update is retried then.
+func (this *rateLimit) recordEvent(key string) {
+	if this.Limit <= 0 {
+		return
+	}
+	var err error
+	for i := 0; i < rateLimitUpdateAttempts; i++ {
+		err = this.updateRecord(key, time.Now())
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		logline("record rate limit event error:", this.Name, key, err)
+	}
+}
+
+func (this *rateLimit) updateRecord(key string, now time.Time) error {
+	return db.Update(func(txn *badger.Txn) error {
+		record := &RateLimitRecord{Limit: this.Name, Key: key}
+		item, err := txn.Get(RateLimitTable(this.Name, key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			err = item.Value(func(v []byte) error {
+				return json.Unmarshal(v, record)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		this.prune(record, now)
+		record.Events = append(record.Events, now.Format(time.RFC3339Nano))
+		record.Window = this.Window.String()
+		data, _ := json.Marshal(record)
+		return txn.SetEntry(badger.NewEntry(RateLimitTable(this.Name, key), data).WithTTL(this.Window))
+	})
+}
+
+// availableAt returns when the next event is allowed, zero time if allowed now
+func (this *rateLimit) availableAt(key string, now time.Time) (time.Time, error) {
+	if this.Limit <= 0 {
+		return time.Time{}, nil
+	}
+	record := new(RateLimitRecord)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(RateLimitTable(this.Name, key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, record)
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	this.prune(record, now)
+	if len(record.Events) < this.Limit {
+		return time.Time{}, nil
+	}
+	// events are appended in time order
+	oldest, err := time.Parse(time.RFC3339Nano, record.Events[len(record.Events)-this.Limit])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return oldest.Add(this.Window), nil
+}
+
+func registeredDomains(names []string) []string {
+	var result []string
+	found := make(map[string]bool)
+	for _, v := range names {
+		registered, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(strings.ToLower(v), "*."))
+		if err != nil {
+			registered = v
+		}
+		if !found[registered] {
+			found[registered] = true
+			result = append(result, registered)
+		}
+	}
+	return result
+}
+
+func certificateNamesKey(names []string) string {
+	sorted := make([]string, len(names))
+	for i, v := range names {
+		sorted[i] = strings.ToLower(v)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// checkRateLimits returns when a new order of the domain at the CA is allowed without exceeding any limit
+func checkRateLimits(domain *Domain, profile *CaProfile) (time.Time, string) {
+	now := time.Now()
+	caName := profile.Name
+	var deferTime time.Time
+	var reason string
+	check := func(limit *rateLimit, key string) {
+		limit = profile.rateLimit(limit)
+		t, err := limit.availableAt(key, now)
+		if err != nil {
+			logline("check rate limit error:", limit.Name, key, err)
+			return
+		}
+		if t.After(deferTime) {
+			deferTime = t
+			reason = "rate limit " + limit.Name + " reached for " + key
+		}
+	}
+
+	names := domain.Names()
+	accountKey := tenantKey(domain.Tenant, domain.AccountMail)
+	check(newOrdersLimit, accountKey)
+	check(duplicateCertificateLimit, caName+"/"+certificateNamesKey(names))
+	for _, v := range registeredDomains(names) {
+		check(certificatesPerDomainLimit, caName+"/"+v)
+	}
+	for _, v := range names {
+		check(failedValidationLimit, accountKey+"/"+v)
+	}
+	return deferTime, reason
+}
+
+func recordCertificateIssued(domain *Domain, profile *CaProfile) {
+	names := domain.Names()
+	profile.rateLimit(duplicateCertificateLimit).recordEvent(profile.Name + "/" + certificateNamesKey(names))
+	for _, v := range registeredDomains(names) {
+		profile.rateLimit(certificatesPerDomainLimit).recordEvent(profile.Name + "/" + v)
+	}
+}
+
+// rateLimitedUntil returns the retry time of a rateLimited problem,
+// given by the Retry-After header of the response if there is one
+func rateLimitedUntil(err error) (time.Time, bool) {
+	problem := problemOf(err)
+	if problem == nil || problem.Type != rateLimitedProblemType {
+		return time.Time{}, false
+	}
+	if pe, ok := err.(*ProblemError); ok && !pe.RetryAfter.IsZero() {
+		return pe.RetryAfter, true
+	}
+	return time.Now().Add(rateLimitedDelay), true
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or as http date
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// retryAfterTransport remembers the Retry-After header of rate limited responses of a single call,
+// since the acme client returns problem documents without response headers
+type retryAfterTransport struct {
+	base http.RoundTripper
+
+	lock       sync.Mutex
+	retryAfter time.Time
+}
+
+func (this *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := this.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if t, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			this.lock.Lock()
+			this.retryAfter = t
+			this.lock.Unlock()
+		}
+	}
+	return resp, nil
+}
+
+// take returns and clears the last retry time
+func (this *retryAfterTransport) take() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	t := this.retryAfter
+	this.retryAfter = time.Time{}
+	return t
+}
+
+func QueryAllRateLimits() ([]*RateLimitRecord, error) {
+	var result []*RateLimitRecord
+	now := time.Now()
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(RateLimitTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			record := new(RateLimitRecord)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, record)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range result {
+		limit, ok := defaultRateLimits[v.Limit]
+		if !ok {
+			continue
+		}
+		// the window may be overridden by the CA profile
+		if window, err := time.ParseDuration(v.Window); err == nil {
+			limit = &rateLimit{Name: limit.Name, Limit: limit.Limit, Window: window}
+		}
+		limit.prune(v, now)
+	}
+	return result, nil
+}
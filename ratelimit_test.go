@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/eggsampler/acme"
+)
+
+// saveRateLimitEvents stores the events of the limit and key as if recorded at the times
+func saveRateLimitEvents(t *testing.T, limit *rateLimit, key string, times ...time.Time) {
+	record := &RateLimitRecord{Limit: limit.Name, Key: key}
+	for _, v := range times {
+		record.Events = append(record.Events, v.Format(time.RFC3339Nano))
+	}
+	data, _ := json.Marshal(record)
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set(RateLimitTable(limit.Name, key), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitWindow(t *testing.T) {
+	openTestDb(t)
+	limit := &rateLimit{Name: "test", Limit: 3, Window: time.Hour}
+	now := time.Now()
+
+	available, err := limit.availableAt("unknown", now)
+	if err != nil || !available.IsZero() {
+		t.Fatalf("availableAt of unknown key = %v, %v, want zero time", available, err)
+	}
+
+	// events out of the window are not counted
+	saveRateLimitEvents(t, limit, "a", now.Add(-2*time.Hour), now.Add(-50*time.Minute), now.Add(-10*time.Minute))
+	available, err = limit.availableAt("a", now)
+	if err != nil || !available.IsZero() {
+		t.Fatalf("availableAt with 2 events in window = %v, %v, want zero time", available, err)
+	}
+
+	// the limit is available again when the oldest counted event leaves the window
+	saveRateLimitEvents(t, limit, "b", now.Add(-50*time.Minute), now.Add(-30*time.Minute), now.Add(-10*time.Minute), now.Add(-time.Minute))
+	available, err = limit.availableAt("b", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(-30 * time.Minute).Add(time.Hour); !available.Equal(want.Round(0)) {
+		t.Errorf("availableAt with 4 events in window = %v, want %v", available, want)
+	}
+
+	limit.recordEvent("c")
+	limit.recordEvent("c")
+	available, _ = limit.availableAt("c", time.Now())
+	if !available.IsZero() {
+		t.Errorf("limit reached after 2 events: %v", available)
+	}
+	limit.recordEvent("c")
+	available, _ = limit.availableAt("c", time.Now())
+	if !available.After(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("limit not reached after 3 events: %v", available)
+	}
+}
+
+func TestRateLimitPrune(t *testing.T) {
+	limit := &rateLimit{Name: "test", Limit: 1, Window: time.Hour}
+	now := time.Now()
+	inWindow := now.Add(-time.Minute).Format(time.RFC3339Nano)
+	record := &RateLimitRecord{Events: []string{
+		now.Add(-61 * time.Minute).Format(time.RFC3339Nano),
+		"illegal",
+		inWindow,
+	}}
+	limit.prune(record, now)
+	if !reflect.DeepEqual(record.Events, []string{inWindow}) {
+		t.Errorf("pruned events = %v, want %v", record.Events, []string{inWindow})
+	}
+}
+
+func TestRegisteredDomains(t *testing.T) {
+	got := registeredDomains([]string{"www.example.com", "*.Example.com", "a.b.example.co.uk", "example.co.uk", "other.org"})
+	want := []string{"example.com", "example.co.uk", "other.org"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registeredDomains = %v, want %v", got, want)
+	}
+}
+
+func TestCertificateNamesKey(t *testing.T) {
+	a := certificateNamesKey([]string{"www.example.com", "Example.com"})
+	b := certificateNamesKey([]string{"example.com", "www.example.com"})
+	if a != b || a != "example.com,www.example.com" {
+		t.Errorf("keys of the same names differ: %q, %q", a, b)
+	}
+}
+
+func TestRateLimitedUntil(t *testing.T) {
+	_, ok := rateLimitedUntil(nil)
+	if ok {
+		t.Error("nil error is rate limited")
+	}
+	_, ok = rateLimitedUntil(acme.Problem{Type: "urn:ietf:params:acme:error:unauthorized"})
+	if ok {
+		t.Error("unauthorized problem is rate limited")
+	}
+
+	retryAfter := time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)
+	until, ok := rateLimitedUntil(&ProblemError{
+		Message:    "new order error",
+		Problem:    acme.Problem{Type: rateLimitedProblemType, Detail: "too many certificates already issued"},
+		RetryAfter: retryAfter,
+	})
+	if !ok || !until.Equal(retryAfter) {
+		t.Errorf("rateLimitedUntil = %v, %v, want %v", until, ok, retryAfter)
+	}
+
+	// without Retry-After header the default delay is used
+	before := time.Now()
+	until, ok = rateLimitedUntil(acme.Problem{Type: rateLimitedProblemType, Detail: "too many new orders"})
+	if !ok || until.Before(before.Add(rateLimitedDelay)) || until.After(time.Now().Add(rateLimitedDelay)) {
+		t.Errorf("rateLimitedUntil without Retry-After = %v, %v", until, ok)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	values := map[string]time.Time{
+		"120":                           now.Add(2 * time.Minute),
+		" 0 ":                           now,
+		"Tue, 20 Oct 2026 08:30:00 GMT": time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC),
+		"-1":                            {},
+		"tomorrow":                      {},
+		"":                              {},
+	}
+	for value, want := range values {
+		got, ok := parseRetryAfter(value, now)
+		if ok != !want.IsZero() || !got.Equal(want) {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+}
+
+func TestCaProfileRateLimit(t *testing.T) {
+	profile := &CaProfile{Name: "internal", RateLimits: map[string]*RateLimitConfig{
+		newOrdersLimit.Name:        {Limit: 10, Window: "1h"},
+		failedValidationLimit.Name: {Limit: 0},
+	}}
+	if err := profile.validateRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := profile.rateLimit(newOrdersLimit)
+	if limit.Limit != 10 || limit.Window != time.Hour {
+		t.Errorf("overridden limit = %+v", limit)
+	}
+	if limit := profile.rateLimit(duplicateCertificateLimit); limit != duplicateCertificateLimit {
+		t.Errorf("limit without override = %+v", limit)
+	}
+	if limit := (*CaProfile)(nil).rateLimit(newOrdersLimit); limit != newOrdersLimit {
+		t.Errorf("limit of missing profile = %+v", limit)
+	}
+
+	// disabled limits are neither recorded nor checked
+	openTestDb(t)
+	disabled := profile.rateLimit(failedValidationLimit)
+	for i := 0; i < failedValidationLimit.Limit+1; i++ {
+		disabled.recordEvent("a@example.com/www.example.com")
+	}
+	available, err := failedValidationLimit.availableAt("a@example.com/www.example.com", time.Now())
+	if err != nil || !available.IsZero() {
+		t.Errorf("events of disabled limit are recorded: %v, %v", available, err)
+	}
+
+	illegal := map[string]*RateLimitConfig{
+		"certificates_per_week":        {Limit: 1, Window: "1h"},
+		newOrdersLimit.Name:            {Limit: -1, Window: "1h"},
+		duplicateCertificateLimit.Name: {Limit: 5, Window: "a week"},
+		failedValidationLimit.Name:     nil,
+	}
+	for name, v := range illegal {
+		p := &CaProfile{Name: "internal", RateLimits: map[string]*RateLimitConfig{name: v}}
+		if err := p.validateRateLimits(); err == nil {
+			t.Errorf("illegal rate limit %s %+v accepted", name, v)
+		}
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	openTestDb(t)
+	domain := &Domain{Domain: "example.com", AltNames: []string{"www.example.com"}, AccountMail: "a@example.com"}
+	profile := &CaProfile{Name: "letsencrypt"}
+
+	deferTime, reason := checkRateLimits(domain, profile)
+	if !deferTime.IsZero() || len(reason) > 0 {
+		t.Fatalf("new domain is deferred until %v: %s", deferTime, reason)
+	}
+
+	now := time.Now()
+	var events []time.Time
+	for i := 0; i < failedValidationLimit.Limit; i++ {
+		events = append(events, now.Add(-time.Duration(i)*time.Minute))
+	}
+	saveRateLimitEvents(t, failedValidationLimit, "a@example.com/www.example.com", events...)
+	deferTime, reason = checkRateLimits(domain, profile)
+	if !deferTime.After(now) || len(reason) == 0 {
+		t.Errorf("domain with failed validations is deferred until %v: %s", deferTime, reason)
+	}
+
+	// other accounts are not limited by the failed validations
+	domain.AccountMail = "b@example.com"
+	deferTime, _ = checkRateLimits(domain, profile)
+	if !deferTime.IsZero() {
+		t.Errorf("other account is deferred until %v", deferTime)
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter := r.URL.Query().Get("retry_after"); len(retryAfter) > 0 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// transports of concurrent calls only see the responses of their own call
+	limited := &retryAfterTransport{base: http.DefaultTransport}
+	other := &retryAfterTransport{base: http.DefaultTransport}
+	var wg sync.WaitGroup
+	for _, v := range []struct {
+		transport *retryAfterTransport
+		query     string
+	}{{limited, "?retry_after=3600"}, {other, ""}} {
+		wg.Add(1)
+		go func(transport *retryAfterTransport, query string) {
+			defer wg.Done()
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL + query)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(v.transport, v.query)
+	}
+	wg.Wait()
+
+	if until := limited.take(); until.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("retry after of rate limited response = %v", until)
+	}
+	if until := limited.take(); !until.IsZero() {
+		t.Errorf("retry after is not cleared: %v", until)
+	}
+	// Retry-After of successful responses is ignored
+	if until := other.take(); !until.IsZero() {
+		t.Errorf("retry after of other call = %v", until)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Tenants own accounts, domains and api tokens. Accounts and domains are keyed by tenant and name,
+// so tenants may own the same names without seeing each other.
+// Records created before tenants were introduced belong to the default tenant "" and keep their keys.
+
+// tenant names are used in keys and paths of output files
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func validTenantName(tenant string) bool {
+	return len(tenant) == 0 || tenantNamePattern.MatchString(tenant)
+}
+
+// tenantKey is the key of the account mail or domain name of the tenant
+func tenantKey(tenant string, name string) string {
+	if len(tenant) == 0 {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+// validAccountMail rejects mails which may be confused with the keys of other tenants
+func validAccountMail(mail string) bool {
+	return !strings.Contains(mail, "/")
+}
+
+func (this *Domain) key() string {
+	return tenantKey(this.Tenant, this.Domain)
+}
+
+// outputPath returns the path of an output file of the domain under certs,
+// files of tenants are written to the directory of the tenant
+func outputPath(domain *Domain, suffix string) (string, error) {
+	dir := "certs"
+	if len(domain.Tenant) > 0 {
+		dir = filepath.Join(dir, domain.Tenant)
+	}
+	err := os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, domain.Domain+suffix), nil
+}
+
+type principalContextKey struct{}
+
+func withPrincipal(r *http.Request, principal *ApiToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal))
+}
+
+func requestPrincipal(r *http.Request) *ApiToken {
+	principal, _ := r.Context().Value(principalContextKey{}).(*ApiToken)
+	return principal
+}
+
+// requestTenant returns the tenant of the authenticated caller
+func requestTenant(r *http.Request) string {
+	principal := requestPrincipal(r)
+	if principal == nil {
+		return ""
+	}
+	return principal.Tenant
+}
+
+// isSystemAdmin checks whether the caller is an admin of the default tenant, who manages all tenants
+func isSystemAdmin(r *http.Request) bool {
+	principal := requestPrincipal(r)
+	return principal != nil && len(principal.Tenant) == 0 && principal.hasScope(ScopeAdmin)
+}
+
+// tenantAccount queries the account owned by the tenant of the caller
+func tenantAccount(r *http.Request, mail string) (*Account, error) {
+	acc, err := QueryAccountByMail(requestTenant(r), mail)
+	if err != nil {
+		return nil, err
+	}
+	// keys of the default tenant saved before mails were validated
+	if acc.Tenant != requestTenant(r) {
+		return nil, badger.ErrKeyNotFound
+	}
+	return acc, nil
+}
+
+// tenantDomain queries the domain owned by the tenant of the caller
+func tenantDomain(r *http.Request, name string) (*Domain, error) {
+	return QueryDomain(tenantKey(requestTenant(r), name))
+}
+
+// tenantRateLimits keeps the rate limit records of the accounts and registered domains of the tenant
+func tenantRateLimits(tenant string, records []*RateLimitRecord) ([]*RateLimitRecord, error) {
+	accounts := make(map[string]bool)
+	names := make(map[string]bool)
+	domains, err := QueryAllDomain()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range domains {
+		if v.Tenant != tenant {
+			continue
+		}
+		for _, mail := range v.AccountList {
+			accounts[tenantKey(tenant, mail)] = true
+		}
+		names[certificateNamesKey(v.Names())] = true
+		for _, registered := range registeredDomains(v.Names()) {
+			names[registered] = true
+		}
+	}
+
+	var result []*RateLimitRecord
+	for _, v := range records {
+		var owned bool
+		switch v.Limit {
+		case newOrdersLimit.Name:
+			// account key
+			owned = accounts[v.Key]
+		case failedValidationLimit.Name:
+			// account key + "/" + identifier
+			i := strings.LastIndex(v.Key, "/")
+			owned = i > 0 && accounts[v.Key[:i]]
+		default:
+			// ca + "/" + names or registered domain
+			parts := strings.SplitN(v.Key, "/", 2)
+			owned = len(parts) == 2 && names[parts[1]]
+		}
+		if owned {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
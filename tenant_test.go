@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// saveTenantRecords stores an account and a domain of the default tenant and of the tenant "team-a"
+func saveTenantRecords(t *testing.T) {
+	records := map[string]string{
+		"ops@example.com":    "",
+		"team-a@example.com": "team-a",
+	}
+	for mail, tenant := range records {
+		if err := SaveAccount(mail, &Account{Tenant: tenant}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	domains := map[string]string{
+		"ops.example.com":    "",
+		"team-a.example.com": "team-a",
+	}
+	for name, tenant := range domains {
+		domain := &Domain{Tenant: tenant, Domain: name}
+		if err := UpdateDomainDirect(domain.key(), domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tenantRequest(target string, tenant string, scopes ...string) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	return withPrincipal(r, &ApiToken{Id: "test", Tenant: tenant, Scopes: scopes})
+}
+
+func TestTenantRecords(t *testing.T) {
+	openTestDb(t)
+	saveTenantRecords(t)
+
+	r := tenantRequest("/", "team-a", ScopeAdmin)
+	if _, err := tenantAccount(r, "team-a@example.com"); err != nil {
+		t.Error("own account:", err)
+	}
+	if _, err := tenantAccount(r, "ops@example.com"); err != badger.ErrKeyNotFound {
+		t.Errorf("account of default tenant: error %v, want not found", err)
+	}
+	if _, err := tenantDomain(r, "team-a.example.com"); err != nil {
+		t.Error("own domain:", err)
+	}
+	if _, err := tenantDomain(r, "ops.example.com"); err != badger.ErrKeyNotFound {
+		t.Errorf("domain of default tenant: error %v, want not found", err)
+	}
+
+	// callers without principal belong to the default tenant
+	anonymous := httptest.NewRequest("GET", "/", nil)
+	if _, err := tenantAccount(anonymous, "team-a@example.com"); err != badger.ErrKeyNotFound {
+		t.Errorf("account of team-a by default tenant: error %v, want not found", err)
+	}
+	if _, err := tenantDomain(anonymous, "ops.example.com"); err != nil {
+		t.Error("domain of default tenant:", err)
+	}
+
+	// tenants own the same names independently
+	shared := &Domain{Tenant: "team-a", Domain: "ops.example.com", AccountMail: "team-a@example.com"}
+	if err := UpdateDomain(shared.key(), shared); err != nil {
+		t.Fatal("domain of default tenant blocks the same name of team-a:", err)
+	}
+	if err := SaveAccount("ops@example.com", &Account{Tenant: "team-a", AccountName: "team-a ops"}); err != nil {
+		t.Fatal(err)
+	}
+	domain, err := tenantDomain(r, "ops.example.com")
+	if err != nil || domain.AccountMail != "team-a@example.com" {
+		t.Errorf("domain of team-a: %+v, %v", domain, err)
+	}
+	acc, err := tenantAccount(anonymous, "ops@example.com")
+	if err != nil || acc.AccountName == "team-a ops" {
+		t.Errorf("account of default tenant: %+v, %v", acc, err)
+	}
+}
+
+func TestTenantKey(t *testing.T) {
+	if key := tenantKey("", "example.com"); key != "example.com" {
+		t.Errorf("key of default tenant = %s", key)
+	}
+	if key := tenantKey("team-a", "example.com"); key != "team-a/example.com" {
+		t.Errorf("key of team-a = %s", key)
+	}
+
+	tenants := map[string]bool{
+		"":         true,
+		"team-a":   true,
+		"team_2":   true,
+		"Team-A":   false,
+		"-team":    false,
+		"team/a":   false,
+		"../certs": false,
+	}
+	for tenant, want := range tenants {
+		if validTenantName(tenant) != want {
+			t.Errorf("validTenantName(%q) = %v", tenant, !want)
+		}
+	}
+	if validAccountMail("team-a/ops@example.com") {
+		t.Error("mail with tenant separator is valid")
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	paths := map[string]*Domain{
+		filepath.Join("certs", "example.com.key"):           {Domain: "example.com"},
+		filepath.Join("certs", "team-a", "example.com.key"): {Tenant: "team-a", Domain: "example.com"},
+	}
+	for want, domain := range paths {
+		got, err := outputPath(domain, ".key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("outputPath = %s, want %s", got, want)
+		}
+		if info, err := os.Stat(filepath.Dir(got)); err != nil || !info.IsDir() {
+			t.Errorf("directory of %s is not created", got)
+		}
+	}
+}
+
+func TestTenantRateLimits(t *testing.T) {
+	openTestDb(t)
+	saveTenantRecords(t)
+	domain := &Domain{Tenant: "team-a", Domain: "team-a.example.com", AccountList: []string{"team-a@example.com"}}
+	if err := UpdateDomainDirect(domain.key(), domain); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*RateLimitRecord{
+		{Limit: newOrdersLimit.Name, Key: "team-a/team-a@example.com"},
+		{Limit: newOrdersLimit.Name, Key: "team-a@example.com"},
+		{Limit: failedValidationLimit.Name, Key: "team-a/team-a@example.com/team-a.example.com"},
+		{Limit: certificatesPerDomainLimit.Name, Key: "letsencrypt/example.com"},
+		{Limit: duplicateCertificateLimit.Name, Key: "letsencrypt/team-a.example.com"},
+		{Limit: duplicateCertificateLimit.Name, Key: "letsencrypt/ops.example.com"},
+	}
+	result, err := tenantRateLimits("team-a", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, v := range result {
+		keys = append(keys, v.Limit+" "+v.Key)
+	}
+	want := []string{
+		newOrdersLimit.Name + " team-a/team-a@example.com",
+		failedValidationLimit.Name + " team-a/team-a@example.com/team-a.example.com",
+		certificatesPerDomainLimit.Name + " letsencrypt/example.com",
+		duplicateCertificateLimit.Name + " letsencrypt/team-a.example.com",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("rate limits of team-a = %v, want %v", keys, want)
+	}
+}
+
+func TestIsSystemAdmin(t *testing.T) {
+	admins := map[*http.Request]bool{
+		tenantRequest("/", "", ScopeAdmin):         true,
+		tenantRequest("/", "", ScopeAccountsWrite): false,
+		tenantRequest("/", "team-a", ScopeAdmin):   false,
+		httptest.NewRequest("GET", "/", nil):       false,
+	}
+	for r, want := range admins {
+		if got := isSystemAdmin(r); got != want {
+			t.Errorf("isSystemAdmin of %+v = %v, want %v", requestPrincipal(r), got, want)
+		}
+	}
+}
+
+func TestTenantListFilters(t *testing.T) {
+	openTestDb(t)
+	saveTenantRecords(t)
+	if _, _, err := NewApiToken("", "ops", []string{ScopeAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewApiToken("team-a", "deploy", []string{ScopeIssuesWrite}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	httpListAccount(w, tenantRequest("/api/v1/list_account", "team-a", ScopeAccountsRead))
+	var accounts []*Account
+	if err := json.Unmarshal(w.Body.Bytes(), &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Tenant != "team-a" {
+		t.Errorf("accounts of team-a: %+v", accounts)
+	}
+
+	w = httptest.NewRecorder()
+	httpListAllIssue(w, tenantRequest("/api/v1/list_issue", "", ScopeIssuesRead))
+	var domains []*Domain
+	if err := json.Unmarshal(w.Body.Bytes(), &domains); err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Domain != "ops.example.com" {
+		t.Errorf("domains of default tenant: %+v", domains)
+	}
+
+	tokenCounts := map[string]int{
+		"team-a": 1,
+		"":       2,
+	}
+	for tenant, want := range tokenCounts {
+		w = httptest.NewRecorder()
+		httpListToken(w, tenantRequest("/api/v1/list_token", tenant, ScopeAdmin))
+		var tokens []*ApiToken
+		if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != want {
+			t.Errorf("tokens listed by admin of %q: %d, want %d", tenant, len(tokens), want)
+		}
+		for _, v := range tokens {
+			if len(v.SecretHash) > 0 {
+				t.Error("secret hash of token is listed")
+			}
+		}
+	}
+}
+
+func TestCreateTokenOfOtherTenant(t *testing.T) {
+	openTestDb(t)
+
+	w := httptest.NewRecorder()
+	httpCreateToken(w, tenantRequest("/api/v1/create_token?name=ci&scope=issues:read&tenant=team-b", "team-a", ScopeAdmin))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("tenant admin created token of other tenant: status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	httpCreateToken(w, tenantRequest("/api/v1/create_token?name=ci&scope=issues:read&tenant=team-b", "", ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("system admin created token of other tenant: status %d", w.Code)
+	}
+	var created struct {
+		Id     string
+		Tenant string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	token, err := QueryApiToken(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Tenant != "team-b" || created.Tenant != "team-b" {
+		t.Errorf("tenant of created token %q", token.Tenant)
+	}
+}
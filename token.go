@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	ScopeAccountsRead  = "accounts:read"
+	ScopeAccountsWrite = "accounts:write"
+	ScopeIssuesRead    = "issues:read"
+	ScopeIssuesWrite   = "issues:write"
+	// admin is granted all scopes
+	ScopeAdmin = "admin"
+)
+
+var apiScopes = map[string]bool{
+	ScopeAccountsRead:  true,
+	ScopeAccountsWrite: true,
+	ScopeIssuesRead:    true,
+	ScopeIssuesWrite:   true,
+	ScopeAdmin:         true,
+}
+
+// ApiToken is a bearer token "<id>.<secret>" of the api, only the hash of the secret is stored
+type ApiToken struct {
+	Id         string
+	Tenant     string
+	Name       string
+	Scopes     []string
+	SecretHash string
+	CreateTime string
+	RevokeTime string
+}
+
+func (this *ApiToken) hasScope(scope string) bool {
+	for _, v := range this.Scopes {
+		if v == scope || v == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// NewApiToken creates and saves a token, the returned token string is not retrievable later
+func NewApiToken(tenant string, name string, scopes []string) (*ApiToken, string, error) {
+	if !validTenantName(tenant) {
+		return nil, "", errors.New("illegal tenant: " + tenant)
+	}
+	for _, v := range scopes {
+		if !apiScopes[v] {
+			return nil, "", errors.New("unknown scope: " + v)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &ApiToken{
+		Id:         id,
+		Tenant:     tenant,
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: hashTokenSecret(secret),
+		CreateTime: time.Now().Format(time.RFC3339Nano),
+	}
+	err = SaveApiToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return token, id + "." + secret, nil
+}
+
+// authenticate returns the principal of the client certificate or the token of the bearer credential in the request
+func authenticate(r *http.Request) (*ApiToken, error) {
+	if principal := clientPrincipal(r); principal != nil {
+		return principal, nil
+	}
+	// with required client certificates the certificate is the only credential
+	if config.ApiTls != nil && config.ApiTls.RequireClientCert {
+		return nil, errors.New("client certificate matches no principal")
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.New("no bearer token")
+	}
+	credential := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+
+	// bootstrap token of the config file
+	if len(config.AdminToken) > 0 && subtle.ConstantTimeCompare([]byte(credential), []byte(config.AdminToken)) == 1 {
+		return &ApiToken{Id: "config", Name: "config admin token", Scopes: []string{ScopeAdmin}}, nil
+	}
+
+	parts := strings.SplitN(credential, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+	token, err := QueryApiToken(parts[0])
+	if err == badger.ErrKeyNotFound {
+		return nil, errors.New("unknown token: " + parts[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashTokenSecret(parts[1])), []byte(token.SecretHash)) != 1 {
+		return nil, errors.New("wrong secret of token: " + token.Id)
+	}
+	if len(token.RevokeTime) > 0 {
+		return nil, errors.New("token is revoked: " + token.Id)
+	}
+	return token, nil
+}
+
+// requireScope rejects requests without a token granted the scope
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := authenticate(r)
+		if err != nil {
+			logline("authentication error:", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("error occurs."))
+			return
+		}
+		if !token.hasScope(scope) {
+			logline("token", token.Id, "has no scope", scope, "of", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("error occurs."))
+			return
+		}
+		handler(w, withPrincipal(r, token))
+	}
+}
+
+func httpCreateToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	namePtr := param("name", q)
+	scopes := q["scope"]
+	if namePtr == nil || len(*namePtr) == 0 || len(scopes) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	// tokens of other tenants are created by the system admin only
+	tenant := requestTenant(r)
+	if tenantPtr := param("tenant", q); tenantPtr != nil && *tenantPtr != tenant {
+		if !isSystemAdmin(r) {
+			logline("create token of other tenant is not allowed:", *tenantPtr)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("error occurs."))
+			return
+		}
+		tenant = *tenantPtr
+	}
+
+	token, tokenString, err := NewApiToken(tenant, *namePtr, scopes)
+	if err != nil {
+		logline("create token error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"Id":     token.Id,
+		"Tenant": token.Tenant,
+		"Scopes": token.Scopes,
+		"Token":  tokenString,
+	})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func httpListToken(w http.ResponseWriter, r *http.Request) {
+	result, err := QueryAllApiTokens()
+	if err != nil {
+		logline("query error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	var filtered []*ApiToken
+	for _, v := range result {
+		if v.Tenant != requestTenant(r) && !isSystemAdmin(r) {
+			continue
+		}
+		v.SecretHash = ""
+		filtered = append(filtered, v)
+	}
+
+	data, _ := json.Marshal(filtered)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func httpRevokeToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	idPtr := param("id", q)
+	if idPtr == nil || len(*idPtr) == 0 {
+		logline("one of params is empty.")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+
+	token, err := QueryApiToken(*idPtr)
+	if err == nil && token.Tenant != requestTenant(r) && !isSystemAdmin(r) {
+		err = badger.ErrKeyNotFound
+	}
+	if err != nil {
+		logline("query token error:", *idPtr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error occurs."))
+		return
+	}
+	if len(token.RevokeTime) == 0 {
+		token.RevokeTime = time.Now().Format(time.RFC3339Nano)
+		err = SaveApiToken(token)
+		if err != nil {
+			logline("save token error:", *idPtr, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("error occurs."))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("submit."))
+}
+
+func SaveApiToken(token *ApiToken) error {
+	data, _ := json.Marshal(token)
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(TokenTable(token.Id), data)
+	})
+}
+
+func QueryApiToken(id string) (*ApiToken, error) {
+	token := new(ApiToken)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(TokenTable(id))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, token)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func QueryAllApiTokens() ([]*ApiToken, error) {
+	var result []*ApiToken
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(TokenTablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			token := new(ApiToken)
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, token)
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// clientPrincipal maps the verified client certificate of the request to its principal
+func clientPrincipal(r *http.Request) *ApiToken {
+	if config.ApiTls == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	var sans []string
+	sans = append(sans, leaf.DNSNames...)
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, v := range leaf.URIs {
+		sans = append(sans, v.String())
+	}
+
+	for _, v := range config.ApiTls.ClientPrincipals {
+		if len(v.CommonName) > 0 && v.CommonName != leaf.Subject.CommonName {
+			continue
+		}
+		if len(v.San) > 0 && !containsString(sans, v.San) {
+			continue
+		}
+		return &ApiToken{Id: "mtls:" + v.Name, Tenant: v.Tenant, Name: v.Name, Scopes: v.Scopes}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
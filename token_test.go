@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func bearerRequest(credential string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/v1/list_account", nil)
+	if len(credential) > 0 {
+		r.Header.Set("Authorization", "Bearer "+credential)
+	}
+	return r
+}
+
+func TestHasScope(t *testing.T) {
+	reader := &ApiToken{Scopes: []string{ScopeAccountsRead, ScopeIssuesRead}}
+	admin := &ApiToken{Scopes: []string{ScopeAdmin}}
+
+	if !reader.hasScope(ScopeIssuesRead) {
+		t.Error("granted scope is missing")
+	}
+	if reader.hasScope(ScopeIssuesWrite) {
+		t.Error("write scope is granted to a read token")
+	}
+	for scope := range apiScopes {
+		if !admin.hasScope(scope) {
+			t.Error("admin token has no scope", scope)
+		}
+	}
+	if (&ApiToken{}).hasScope(ScopeAccountsRead) {
+		t.Error("token without scopes has a scope")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{AdminToken: "bootstrap-secret"})
+
+	token, credential, err := NewApiToken("", "deploy", []string{ScopeIssuesWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedCredential, err := NewApiToken("", "old", []string{ScopeIssuesWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.RevokeTime = time.Now().Format(time.RFC3339Nano)
+	if err := SaveApiToken(revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := authenticate(bearerRequest(credential))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != token.Id || !got.hasScope(ScopeIssuesWrite) {
+		t.Errorf("authenticated token %+v, want %s", got, token.Id)
+	}
+
+	got, err = authenticate(bearerRequest("bootstrap-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.hasScope(ScopeAdmin) {
+		t.Error("config admin token has no admin scope")
+	}
+
+	rejected := map[string]*http.Request{
+		"no authorization": bearerRequest(""),
+		"basic auth":       httptest.NewRequest("GET", "/", nil),
+		"malformed token":  bearerRequest("no-separator"),
+		"unknown id":       bearerRequest("0000000000000000.secret"),
+		"wrong secret":     bearerRequest(token.Id + ".secret"),
+		"revoked token":    bearerRequest(revokedCredential),
+	}
+	rejected["basic auth"].SetBasicAuth("admin", "bootstrap-secret")
+	for name, r := range rejected {
+		if _, err := authenticate(r); err == nil {
+			t.Errorf("%s: authentication succeeded", name)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{})
+
+	_, credential, err := NewApiToken("", "reader", []string{ScopeIssuesRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requireScope(ScopeIssuesRead, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	writeHandler := requireScope(ScopeIssuesWrite, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called without scope")
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, bearerRequest(credential))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("granted request: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, bearerRequest(""))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("anonymous request: status %d, want %d with challenge", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	writeHandler(w, bearerRequest(credential))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("request without scope: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestNewApiTokenUnknownScope(t *testing.T) {
+	openTestDb(t)
+	if _, _, err := NewApiToken("", "bad", []string{"domains:write"}); err == nil {
+		t.Error("token with unknown scope created")
+	}
+}
+
+func clientCertRequest(t *testing.T, commonName string, dnsNames ...string) *http.Request {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bearerRequest("")
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+	return r
+}
+
+func TestClientPrincipal(t *testing.T) {
+	openTestDb(t)
+	useTestConfig(t, &Config{ApiTls: &ApiTlsConfig{ClientPrincipals: []*ClientPrincipal{
+		{Name: "deployer", CommonName: "deploy", Scopes: []string{ScopeIssuesWrite}},
+		{Name: "monitor", San: "monitor.example.com", Scopes: []string{ScopeIssuesRead}},
+		{Name: "both", CommonName: "ops", San: "ops.example.com", Scopes: []string{ScopeAdmin}},
+	}}})
+
+	principals := map[string]struct {
+		r    *http.Request
+		want string
+	}{
+		"common name":              {clientCertRequest(t, "deploy"), "deployer"},
+		"dns san":                  {clientCertRequest(t, "host-17", "monitor.example.com"), "monitor"},
+		"common name and san":      {clientCertRequest(t, "ops", "ops.example.com"), "both"},
+		"common name without san":  {clientCertRequest(t, "ops"), ""},
+		"san of another principal": {clientCertRequest(t, "ops", "monitor.example.com"), "monitor"},
+		"unknown certificate":      {clientCertRequest(t, "stranger", "www.example.com"), ""},
+		"no certificate":           {bearerRequest(""), ""},
+	}
+	for name, v := range principals {
+		t.Run(name, func(t *testing.T) {
+			principal := clientPrincipal(v.r)
+			if len(v.want) == 0 {
+				if principal != nil {
+					t.Errorf("got principal %s", principal.Name)
+				}
+				return
+			}
+			if principal == nil || principal.Name != v.want {
+				t.Fatalf("got principal %+v, want %s", principal, v.want)
+			}
+			if principal.Id != "mtls:"+v.want {
+				t.Errorf("principal id %s", principal.Id)
+			}
+		})
+	}
+
+	principal, err := authenticate(clientCertRequest(t, "deploy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !principal.hasScope(ScopeIssuesWrite) || principal.hasScope(ScopeAccountsWrite) {
+		t.Errorf("scopes of principal %v", principal.Scopes)
+	}
+
+	// bearer tokens are not accepted instead of a certificate without principal
+	_, credential, err := NewApiToken("", "ci", []string{ScopeIssuesWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := clientCertRequest(t, "stranger")
+	r.Header.Set("Authorization", "Bearer "+credential)
+	if _, err := authenticate(r); err != nil {
+		t.Errorf("bearer token with optional client certificate: %v", err)
+	}
+	config.ApiTls.RequireClientCert = true
+	if _, err := authenticate(r); err == nil {
+		t.Error("certificate without principal is accepted with required client certificates")
+	}
+	if _, err := authenticate(clientCertRequest(t, "deploy")); err != nil {
+		t.Errorf("certificate of principal with required client certificates: %v", err)
+	}
+
+	config.ApiTls = nil
+	if clientPrincipal(clientCertRequest(t, "deploy")) != nil {
+		t.Error("principal without api tls config")
+	}
+}